@@ -3,33 +3,77 @@ package main
 import (
 	"flag"
 	"github.com/getsentry/raven-go"
-	"github.com/gorilla/handlers"
 	"github.com/hunter7654/go-api/automatic"
+	"github.com/hunter7654/go-api/config"
 	"github.com/hunter7654/go-api/database"
-	_ "github.com/hunter7654/go-api/handlers/routes"
+	"github.com/hunter7654/go-api/handlers/routes"
+	"github.com/hunter7654/go-api/logging"
 	"github.com/hunter7654/go-api/router"
+	"github.com/hunter7654/go-api/tracing"
 	"net/http"
 	"os"
-	"runtime"
+	"time"
 )
 
-func init() {
-	//sentry path
-	raven.SetDSN("")
-}
 func main() {
 
-	portPtr := flag.String("port", "25566", "The port to run the server on.")
+	configPtr := flag.String("config", "", "The json, yaml or toml file to read the server settings from.")
+	portPtr := flag.String("port", "", "The port to run the server on, overrides the configuration.")
 	flag.Parse()
 
-	//initialises DatabaseConn connection
-	if err := database.InitDB(database.DatabaseConn); err != nil {
-		raven.CaptureError(err, nil)
-	}
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "origin", "content-type", "Authorization", "authorization"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
-	go automatic.Start()
-	go http.ListenAndServe(":"+*portPtr, handlers.LoggingHandler(os.Stdout, handlers.CORS(originsOk, headersOk, methodsOk)(router.NewRouter())))
-	runtime.Goexit()
+	settings, err := config.Load(*configPtr)
+	if err != nil {
+		exit(err)
+	}
+	if *portPtr != "" {
+		settings.Port = *portPtr
+	}
+	if err := logging.SetLevel(settings.LogLevel); err != nil {
+		exit(err)
+	}
+
+	//sentry path
+	raven.SetDSN(settings.SentryDSN)
+	database.JsonKey = settings.JwtSecret
+	routes.SetLDAPSettings(settings.LDAP)
+	router.SetDefaultTimeout(time.Duration(settings.StatementTimeout) * time.Second)
+	flushTraces, err := tracing.Start(settings.Tracing)
+	if err != nil {
+		exit(err)
+	}
+	for name, source := range dataSources(settings) {
+		if err := database.AddDataSource(name, source); err != nil {
+			exit(err)
+		}
+	}
+
+	//initialises the connection of every registered data source
+	for _, name := range database.DataSourceNames() {
+		if err := database.InitDB(database.GetDataSource(name)); err != nil {
+			logging.Logger.Error("data source not connected", "datasource", name, "error", err.Error())
+			raven.CaptureError(err, map[string]string{"datasource": name})
+		}
+	}
+	cors := newCorsHandler(router.NewRouter(), settings.CORS)
+	go reloadOnHangup(*configPtr, settings, cors)
+	automatic.Start()
+	servers := []*http.Server{{Addr: ":" + settings.Port, Handler: cors}}
+	if settings.TLS.Enabled() {
+		if servers[0].TLSConfig, err = tlsConfig(settings.TLS); err != nil {
+			exit(err)
+		}
+	}
+	if settings.TLS.RedirectPort != "" {
+		servers = append(servers, &http.Server{Addr: ":" + settings.TLS.RedirectPort, Handler: redirectToHTTPS(settings.Port)})
+	}
+	for _, server := range servers {
+		go serve(server)
+	}
+	shutdownOnSignal(time.Duration(settings.ShutdownTimeout)*time.Second, flushTraces, servers...)
+}
+
+//logs the error that stopped the server from running and exits
+func exit(err error) {
+	logging.Logger.Error("server stopped", "error", err.Error())
+	os.Exit(1)
 }
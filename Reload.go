@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/getsentry/raven-go"
+	"github.com/gorilla/handlers"
+	"github.com/hunter7654/go-api/config"
+	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/handlers/routes"
+	"github.com/hunter7654/go-api/logging"
+	"github.com/hunter7654/go-api/router"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//sits in front of the router so the cors policy can be swapped without rebuilding the router
+type corsHandler struct {
+	router  http.Handler
+	current atomic.Value
+}
+
+func newCorsHandler(router http.Handler, settings config.CORS) *corsHandler {
+	handler := &corsHandler{router: router}
+	handler.setPolicy(settings)
+	return handler
+}
+
+func (handler *corsHandler) setPolicy(settings config.CORS) {
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "origin", "content-type", "Authorization", "authorization", database.DataSourceHeader})
+	originsOk := handlers.AllowedOrigins(settings.AllowedOrigins)
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
+	handler.current.Store(handlers.CORS(originsOk, headersOk, methodsOk)(handler.router))
+}
+
+func (handler *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler.current.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+//re-reads the configuration file every time the server is sent SIGHUP and applies the data sources, log level,
+//ldap settings, statement timeout, cors policy and sentry dsn. The port, jwt secret, shutdown timeout, tls and tracing
+//settings are only read when the server starts, so changes to them are logged as requiring a restart. If any of
+//the new data sources can not be connected the old ones are kept but the rest of the settings are still applied
+func reloadOnHangup(path string, settings config.Config, cors *corsHandler) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		reloaded, err := config.Load(path)
+		if err != nil {
+			logging.Logger.Error("configuration not reloaded", "error", err.Error())
+			raven.CaptureError(err, nil)
+			continue
+		}
+		if err := database.ReplaceDataSources(dataSources(reloaded), time.Duration(settings.ShutdownTimeout)*time.Second); err != nil {
+			//the other settings are still applied, the data sources are tried again on the next reload
+			logging.Logger.Error("data sources not reloaded", "error", err.Error())
+			raven.CaptureError(err, nil)
+			reloaded.DataSources = settings.DataSources
+		}
+		if err := logging.SetLevel(reloaded.LogLevel); err != nil {
+			logging.Logger.Error("log level not reloaded", "error", err.Error())
+			reloaded.LogLevel = settings.LogLevel
+		}
+		routes.SetLDAPSettings(reloaded.LDAP)
+		router.SetDefaultTimeout(time.Duration(reloaded.StatementTimeout) * time.Second)
+		cors.setPolicy(reloaded.CORS)
+		raven.SetDSN(reloaded.SentryDSN)
+		changes := reloaded.Changes(settings)
+		if len(changes) == 0 {
+			logging.Logger.Info("configuration reloaded", "change", "none")
+		}
+		for _, change := range changes {
+			logging.Logger.Info("configuration reloaded", "change", change)
+		}
+		settings = reloaded.KeepStartupSettings(settings)
+	}
+}
+
+//builds the data sources listed in the configuration, without connecting them
+func dataSources(settings config.Config) map[string]*database.DataSource {
+	sources := make(map[string]*database.DataSource, len(settings.DataSources))
+	for name, source := range settings.DataSources {
+		sources[name] = &database.DataSource{Driver: source.Driver, ConnectionString: source.ConnectionString}
+	}
+	return sources
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"github.com/hunter7654/go-api/automatic"
+	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/logging"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//blocks until the server is sent SIGINT or SIGTERM, then stops the servers accepting connections and waits up to
+//timeout for the running requests and automatic jobs to finish. Any transaction still open after that
+//is rolled back before the connection pools are closed and the remaining spans are sent with flushTraces
+func shutdownOnSignal(timeout time.Duration, flushTraces func(context.Context) error, servers ...*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	logging.Logger.Info("shutting down", "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			logging.Logger.Warn("requests still running", "addr", server.Addr, "error", err.Error())
+		}
+	}
+	if err := automatic.Stop(ctx); err != nil {
+		logging.Logger.Warn("automatic jobs still running", "error", err.Error())
+	}
+	database.RollbackTransactions()
+	if err := database.CloseDataSources(); err != nil {
+		logging.Logger.Error("data sources not closed", "error", err.Error())
+	}
+	if err := flushTraces(ctx); err != nil {
+		logging.Logger.Warn("traces not sent", "error", err.Error())
+	}
+	logging.Logger.Info("shut down")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/hunter7654/go-api/config"
+	"github.com/hunter7654/go-api/logging"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//how often the certificate files are checked for changes
+const certificateCheckInterval = 30 * time.Second
+
+//builds the tls settings the server is served with. The certificate is reloaded whenever its files change
+//and client certificates are checked against the client ca file if one is set
+func tlsConfig(settings config.TLS) (*tls.Config, error) {
+	certificates, err := newCertificateReloader(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	go certificates.watch(certificateCheckInterval)
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certificates.GetCertificate,
+	}
+	if settings.ClientCAFile != "" {
+		pem, err := os.ReadFile(settings.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client ca file : " + settings.ClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if settings.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsConfig, nil
+}
+
+//holds the server certificate and swaps it for a new one when the certificate or key file is changed
+type certificateReloader struct {
+	certFile    string
+	keyFile     string
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	modified    time.Time
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+//loads the certificate again if either file has been modified since it was last loaded
+func (reloader *certificateReloader) reloadIfChanged() (bool, error) {
+	var modified time.Time
+	for _, path := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	reloader.lock.RLock()
+	unchanged := modified.Equal(reloader.modified)
+	reloader.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+	reloader.certificate, reloader.modified = &certificate, modified
+	return true, nil
+}
+
+//checks the files for changes every interval. The old certificate is kept if the new one can not be loaded,
+//which also covers the certificate and key being written one after the other
+func (reloader *certificateReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := reloader.reloadIfChanged()
+		if err != nil {
+			logging.Logger.Error("certificate not reloaded", "error", err.Error())
+		} else if reloaded {
+			logging.Logger.Info("certificate reloaded", "file", reloader.certFile)
+		}
+	}
+}
+
+func (reloader *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+	return reloader.certificate, nil
+}
+
+//redirects every request to the same url over https on the port
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+//serves the server until it is shut down, over https if it has tls settings
+func serve(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		exit(err)
+	}
+}
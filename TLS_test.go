@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/hunter7654/go-api/config"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writes a self signed certificate and its key to cert.pem and key.pem in dir, dated modified
+func writeCertificate(t *testing.T, dir string, commonName string, modified time.Time) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), modified)
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), modified)
+	return
+}
+
+func writeFile(t *testing.T, path string, data []byte, modified time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//returns the common name of the certificate the reloader is serving
+func servedName(t *testing.T, reloader *certificateReloader) string {
+	t.Helper()
+	certificate, _ := reloader.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Hour)
+	certFile, keyFile := writeCertificate(t, dir, "first", start)
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, reloader); name != "first" {
+		t.Errorf("got certificate %s, want first", name)
+	}
+	if reloaded, err := reloader.reloadIfChanged(); reloaded || err != nil {
+		t.Errorf("got reloaded %v %v without a change, want nothing done", reloaded, err)
+	}
+
+	writeCertificate(t, dir, "second", start.Add(time.Minute))
+	if reloaded, err := reloader.reloadIfChanged(); !reloaded || err != nil {
+		t.Errorf("got reloaded %v %v after a change, want the certificate reloaded", reloaded, err)
+	}
+	if name := servedName(t, reloader); name != "second" {
+		t.Errorf("got certificate %s, want second", name)
+	}
+
+	//a certificate that is only half written is not loaded and the old one is kept
+	writeFile(t, certFile, []byte("-----BEGIN CERTIFICATE-----"), start.Add(2*time.Minute))
+	if reloaded, err := reloader.reloadIfChanged(); reloaded || err == nil {
+		t.Errorf("got reloaded %v %v from a broken certificate, want an error", reloaded, err)
+	}
+	if name := servedName(t, reloader); name != "second" {
+		t.Errorf("got certificate %s after a failed reload, want second kept", name)
+	}
+}
+
+func TestTLSConfigClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "server", time.Now())
+	noCertificates := filepath.Join(dir, "empty.pem")
+	writeFile(t, noCertificates, []byte("no certificates here"), time.Now())
+	tests := []struct {
+		clientCAFile      string
+		requireClientCert bool
+		clientAuth        tls.ClientAuthType
+	}{
+		{"", false, tls.NoClientCert},
+		{certFile, false, tls.VerifyClientCertIfGiven},
+		{certFile, true, tls.RequireAndVerifyClientCert},
+	}
+	for _, test := range tests {
+		settings := config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: test.clientCAFile, RequireClientCert: test.requireClientCert}
+		tlsConfig, err := tlsConfig(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlsConfig.ClientAuth != test.clientAuth {
+			t.Errorf("%+v: got client auth %v, want %v", settings, tlsConfig.ClientAuth, test.clientAuth)
+		}
+		if (tlsConfig.ClientCAs != nil) != (test.clientCAFile != "") {
+			t.Errorf("%+v: got client cas %v", settings, tlsConfig.ClientCAs)
+		}
+	}
+	if _, err := tlsConfig(config.TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: noCertificates}); err == nil {
+		t.Error("got no error from a client ca file without certificates")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		host     string
+		port     string
+		location string
+	}{
+		{"example.com:80", "8443", "https://example.com:8443/webservices/x?format=csv"},
+		{"example.com", "8443", "https://example.com:8443/webservices/x?format=csv"},
+		{"example.com:8080", "443", "https://example.com/webservices/x?format=csv"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://"+test.host+"/webservices/x?format=csv", nil)
+		res := httptest.NewRecorder()
+		redirectToHTTPS(test.port).ServeHTTP(res, req)
+		if res.Code != http.StatusPermanentRedirect || res.Header().Get("Location") != test.location {
+			t.Errorf("%s to %s: got %d %s, want %s", test.host, test.port, res.Code, res.Header().Get("Location"), test.location)
+		}
+	}
+}
@@ -1,37 +1,83 @@
 package automatic
 
 import (
+	"context"
 	"github.com/hunter7654/go-api/database"
-	"encoding/json"
-	"fmt"
-	"github.com/getsentry/raven-go"
+	"github.com/hunter7654/go-api/logging"
+	"github.com/hunter7654/go-api/metrics"
+	"sync"
 	"time"
 )
 
+//closed by Stop to tell the jobs not to run again
+var stop = make(chan struct{})
+
+//counts the jobs that have not returned yet
+var jobs sync.WaitGroup
+
 func Start() {
-	go doEvery(60*time.Minute, TestFunc)
+	every("TestFunc", 60*time.Minute, TestFunc)
+}
+
+//starts running f every d until Stop is called. name is used to label the job's metrics
+func every(name string, d time.Duration, f func()) {
+	jobs.Add(1)
+	go doEvery(name, d, f)
+}
+
+func doEvery(name string, d time.Duration, f func()) {
+	defer jobs.Done()
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			run(name, f)
+		}
+	}
 }
 
-func doEvery(d time.Duration, f func()) {
-	defer handleError()
-	for range time.Tick(d) {
-		f()
+//runs the job once, counting the run and any failure. A job that panics is recovered so it still runs next time
+func run(name string, f func()) {
+	metrics.JobRuns.WithLabelValues(name).Inc()
+	defer handleError(name)
+	f()
+}
+
+//stops the jobs from running again and waits for any that are running to finish,
+//or until ctx is done in which case its error is returned
+func Stop(ctx context.Context) error {
+	close(stop)
+	finished := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
 func TestFunc() {
-	//do something here
+	//do something here. The Try database functions return their errors rather than panicking so a job can
+	//handle the ones it expects, e.g. errors.Is(err, database.ErrUnavailable) to wait for the next run
 }
 
-func handleError() {
+//recovers a job that panicked with anything, including runtime errors, then logs it and sends it to Sentry
+func handleError(name string) {
 	if r := recover(); r != nil {
-		if response, ok := r.(database.ErrorResponse); ok {
-			if response.ErrorObject != nil {
-				raven.CaptureError(response.ErrorObject, nil)
-			}
-			data, _ := json.Marshal(response)
-			fmt.Println(string(data))
-			return
+		metrics.JobFailures.WithLabelValues(name).Inc()
+		err := database.AsError(r)
+		cause := err.Error()
+		if err.Err != nil {
+			cause = err.Err.Error()
 		}
+		logging.Logger.Error("automatic job failed", "job", name, "code", err.Code, "error", cause, "stack", err.StackTrace)
+		err.Capture(map[string]string{"job": name})
 	}
 }
@@ -0,0 +1,382 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//the prefix of every environment variable that overrides the configuration file
+const EnvPrefix = "GOAPI_"
+
+//the data source requests use when they do not name one, the same name as database.DefaultDataSource
+const DefaultDataSource = "default"
+
+//the settings the server is started with
+type Config struct {
+	Port      string `json:"port" yaml:"port" toml:"port"`
+	JwtSecret string `json:"jwt_secret" yaml:"jwt_secret" toml:"jwt_secret"`
+	SentryDSN string `json:"sentry_dsn" yaml:"sentry_dsn" toml:"sentry_dsn"`
+	//the lowest level of log line that is written, either debug, info, warn or error
+	LogLevel string `json:"log_level" yaml:"log_level" toml:"log_level"`
+	//the number of seconds running requests and jobs are given to finish when the server is shut down
+	ShutdownTimeout int `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	//the number of seconds the database statements of a request are given before they are cancelled and the request
+	//is answered with 504, for routes that do not set their own timeout. 0 leaves them without a limit
+	StatementTimeout int                   `json:"statement_timeout" yaml:"statement_timeout" toml:"statement_timeout"`
+	TLS              TLS                   `json:"tls" yaml:"tls" toml:"tls"`
+	Tracing          Tracing               `json:"tracing" yaml:"tracing" toml:"tracing"`
+	CORS             CORS                  `json:"cors" yaml:"cors" toml:"cors"`
+	LDAP             LDAP                  `json:"ldap" yaml:"ldap" toml:"ldap"`
+	DataSources      map[string]DataSource `json:"datasources" yaml:"datasources" toml:"datasources"`
+}
+
+//where the request and database spans are sent. Exporter can be "otlp", "stdout" or empty to turn tracing off
+type Tracing struct {
+	Exporter string `json:"exporter" yaml:"exporter" toml:"exporter"`
+	//the host and port of the otlp http collector, e.g. localhost:4318
+	Endpoint    string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+	Insecure    bool   `json:"insecure" yaml:"insecure" toml:"insecure"`
+	ServiceName string `json:"service_name" yaml:"service_name" toml:"service_name"`
+}
+
+//the certificates the server is served over https with. If no certificate is set plain http is used
+type TLS struct {
+	CertFile string `json:"cert_file" yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file" toml:"key_file"`
+	//the certificate authorities client certificates are checked against. Clients that pass no certificate
+	//are still let in unless RequireClientCert is set
+	ClientCAFile      string `json:"client_ca_file" yaml:"client_ca_file" toml:"client_ca_file"`
+	RequireClientCert bool   `json:"require_client_cert" yaml:"require_client_cert" toml:"require_client_cert"`
+	//if set, plain http requests to this port are redirected to https
+	RedirectPort string `json:"redirect_port" yaml:"redirect_port" toml:"redirect_port"`
+}
+
+//reports whether the server should be served over https
+func (settings TLS) Enabled() bool {
+	return settings.CertFile != ""
+}
+
+type CORS struct {
+	AllowedOrigins []string `json:"allowed_origins" yaml:"allowed_origins" toml:"allowed_origins"`
+}
+
+//the settings used to check usernames and passwords when logging in
+type LDAP struct {
+	Host              string `json:"host" yaml:"host" toml:"host"`
+	Port              int    `json:"port" yaml:"port" toml:"port"`
+	Base              string `json:"base" yaml:"base" toml:"base"`
+	UseSSL            bool   `json:"use_ssl" yaml:"use_ssl" toml:"use_ssl"`
+	BindDN            string `json:"bind_dn" yaml:"bind_dn" toml:"bind_dn"`
+	BindPassword      string `json:"bind_password" yaml:"bind_password" toml:"bind_password"`
+	UserFilter        string `json:"user_filter" yaml:"user_filter" toml:"user_filter"`
+	UsernameAttribute string `json:"username_attribute" yaml:"username_attribute" toml:"username_attribute"`
+	//if set, /readyz also checks that the ldap server can be reached
+	CheckReadiness bool `json:"check_readiness" yaml:"check_readiness" toml:"check_readiness"`
+}
+
+type DataSource struct {
+	Driver           string `json:"driver" yaml:"driver" toml:"driver"`
+	ConnectionString string `json:"connection_string" yaml:"connection_string" toml:"connection_string"`
+}
+
+//the jwt secret the server used to ship with. It is public so tokens signed with it can be forged
+const placeholderSecret = "RandomKeyHere"
+
+//the drivers that are compiled in to the server
+var Drivers = []string{"oci8", "mssql", "sqlserver", "postgres", "sqlite3"}
+
+//returns the configuration used when no file or environment variables are passed
+func Default() Config {
+	return Config{
+		Port:            "25566",
+		ShutdownTimeout: 30,
+		LogLevel:        "info",
+		Tracing:         Tracing{ServiceName: "go-api"},
+		CORS:            CORS{AllowedOrigins: []string{"*"}},
+		DataSources:     map[string]DataSource{},
+	}
+}
+
+//reads the configuration file at path, if one is passed, on top of the defaults and then applies
+//any environment variable overrides. The file format is chosen from its extension
+//which can be .json, .yaml, .yml or .toml
+func Load(path string) (Config, error) {
+	config := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			err = json.Unmarshal(data, &config)
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &config)
+		case ".toml":
+			err = toml.Unmarshal(data, &config)
+		default:
+			err = errors.New("configuration file type not recognised : " + path)
+		}
+		if err != nil {
+			return config, err
+		}
+	}
+	if err := config.applyEnvironment(os.Environ()); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+//overrides settings with GOAPI_ environment variables. Data sources are set with
+//GOAPI_DATASOURCE_<NAME>_DRIVER and GOAPI_DATASOURCE_<NAME>_CONNECTION_STRING
+func (config *Config) applyEnvironment(environment []string) error {
+	var err error
+	for _, variable := range environment {
+		split := strings.SplitN(variable, "=", 2)
+		if len(split) != 2 || !strings.HasPrefix(split[0], EnvPrefix) {
+			continue
+		}
+		name, value := strings.TrimPrefix(split[0], EnvPrefix), split[1]
+		switch name {
+		case "PORT":
+			config.Port = value
+		case "JWT_SECRET":
+			config.JwtSecret = value
+		case "SENTRY_DSN":
+			config.SentryDSN = value
+		case "LOG_LEVEL":
+			config.LogLevel = value
+		case "SHUTDOWN_TIMEOUT":
+			config.ShutdownTimeout, err = strconv.Atoi(value)
+		case "STATEMENT_TIMEOUT":
+			config.StatementTimeout, err = strconv.Atoi(value)
+		case "TLS_CERT_FILE":
+			config.TLS.CertFile = value
+		case "TLS_KEY_FILE":
+			config.TLS.KeyFile = value
+		case "TLS_CLIENT_CA_FILE":
+			config.TLS.ClientCAFile = value
+		case "TLS_REQUIRE_CLIENT_CERT":
+			config.TLS.RequireClientCert, err = strconv.ParseBool(value)
+		case "TLS_REDIRECT_PORT":
+			config.TLS.RedirectPort = value
+		case "TRACING_EXPORTER":
+			config.Tracing.Exporter = value
+		case "TRACING_ENDPOINT":
+			config.Tracing.Endpoint = value
+		case "TRACING_INSECURE":
+			config.Tracing.Insecure, err = strconv.ParseBool(value)
+		case "TRACING_SERVICE_NAME":
+			config.Tracing.ServiceName = value
+		case "CORS_ALLOWED_ORIGINS":
+			config.CORS.AllowedOrigins = strings.Split(value, ",")
+		case "LDAP_HOST":
+			config.LDAP.Host = value
+		case "LDAP_PORT":
+			config.LDAP.Port, err = strconv.Atoi(value)
+		case "LDAP_BASE":
+			config.LDAP.Base = value
+		case "LDAP_USE_SSL":
+			config.LDAP.UseSSL, err = strconv.ParseBool(value)
+		case "LDAP_BIND_DN":
+			config.LDAP.BindDN = value
+		case "LDAP_BIND_PASSWORD":
+			config.LDAP.BindPassword = value
+		case "LDAP_USER_FILTER":
+			config.LDAP.UserFilter = value
+		case "LDAP_USERNAME_ATTRIBUTE":
+			config.LDAP.UsernameAttribute = value
+		case "LDAP_CHECK_READINESS":
+			config.LDAP.CheckReadiness, err = strconv.ParseBool(value)
+		default:
+			if strings.HasPrefix(name, "DATASOURCE_") {
+				err = config.applyDataSourceVariable(strings.TrimPrefix(name, "DATASOURCE_"), value)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s : %v", split[0], err)
+		}
+	}
+	return nil
+}
+
+func (config *Config) applyDataSourceVariable(name string, value string) error {
+	if config.DataSources == nil {
+		config.DataSources = map[string]DataSource{}
+	}
+	for _, setting := range []string{"_DRIVER", "_CONNECTION_STRING"} {
+		if !strings.HasSuffix(name, setting) {
+			continue
+		}
+		sourceName := strings.ToLower(strings.TrimSuffix(name, setting))
+		source := config.DataSources[sourceName]
+		if setting == "_DRIVER" {
+			source.Driver = value
+		} else {
+			source.ConnectionString = value
+		}
+		config.DataSources[sourceName] = source
+		return nil
+	}
+	return errors.New("expected a name followed by _DRIVER or _CONNECTION_STRING")
+}
+
+//checks that the configuration can be used to start the server
+func (config Config) Validate() error {
+	var problems []string
+	if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, "port must be a number between 1 and 65535")
+	}
+	if config.JwtSecret == "" {
+		problems = append(problems, "jwt_secret must be set")
+	} else if config.JwtSecret == placeholderSecret {
+		problems = append(problems, "jwt_secret must be changed from the example value")
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		problems = append(problems, "tls cert_file and key_file must be set together")
+	}
+	if !config.TLS.Enabled() && (config.TLS.ClientCAFile != "" || config.TLS.RedirectPort != "") {
+		problems = append(problems, "tls client_ca_file and redirect_port need cert_file and key_file to be set")
+	}
+	if config.TLS.RequireClientCert && config.TLS.ClientCAFile == "" {
+		problems = append(problems, "tls require_client_cert needs client_ca_file to be set")
+	}
+	if config.TLS.RedirectPort != "" {
+		if port, err := strconv.Atoi(config.TLS.RedirectPort); err != nil || port < 1 || port > 65535 || config.TLS.RedirectPort == config.Port {
+			problems = append(problems, "tls redirect_port must be a number between 1 and 65535 that is not the port")
+		}
+	}
+	switch strings.ToLower(config.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, "log_level must be debug, info, warn or error")
+	}
+	switch config.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if config.Tracing.Endpoint == "" {
+			problems = append(problems, "tracing endpoint must be set for the otlp exporter")
+		}
+	default:
+		problems = append(problems, "tracing exporter must be otlp, stdout or empty")
+	}
+	if config.ShutdownTimeout < 1 {
+		problems = append(problems, "shutdown_timeout must be at least 1 second")
+	}
+	if config.StatementTimeout < 0 {
+		problems = append(problems, "statement_timeout must not be negative")
+	}
+	if len(config.CORS.AllowedOrigins) == 0 {
+		problems = append(problems, "cors allowed_origins must contain at least one origin")
+	}
+	if config.LDAP.Port < 0 || config.LDAP.Port > 65535 {
+		problems = append(problems, "ldap port must be between 0 and 65535")
+	}
+	hasDefault := false
+	for name, source := range config.DataSources {
+		hasDefault = hasDefault || strings.ToLower(name) == DefaultDataSource
+		if !driverRecognised(source.Driver) {
+			problems = append(problems, "datasource "+name+" driver must be one of "+strings.Join(Drivers, ", "))
+		}
+		if source.ConnectionString == "" {
+			problems = append(problems, "datasource "+name+" connection_string must be set")
+		}
+	}
+	if !hasDefault {
+		problems = append(problems, "datasources must include one named "+DefaultDataSource)
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration : " + strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func driverRecognised(driver string) bool {
+	for _, known := range Drivers {
+		if driver == known {
+			return true
+		}
+	}
+	return false
+}
+
+//added to the changes of settings that are only read when the server starts
+const requiresRestart = " (requires restart)"
+
+//describes each setting that differs from the previous configuration. Secrets are named but their values are left out.
+//Settings that a reload can not apply are marked as requiring a restart
+func (config Config) Changes(previous Config) []string {
+	var changes []string
+	changed := func(name string, old interface{}, new interface{}) {
+		changes = append(changes, fmt.Sprintf("%s changed from %v to %v", name, old, new))
+	}
+	if config.Port != previous.Port {
+		changed("port", previous.Port, config.Port)
+		changes[len(changes)-1] += requiresRestart
+	}
+	if config.JwtSecret != previous.JwtSecret {
+		changes = append(changes, "jwt_secret changed"+requiresRestart)
+	}
+	if config.SentryDSN != previous.SentryDSN {
+		changes = append(changes, "sentry_dsn changed")
+	}
+	if config.LogLevel != previous.LogLevel {
+		changed("log_level", previous.LogLevel, config.LogLevel)
+	}
+	if config.ShutdownTimeout != previous.ShutdownTimeout {
+		changed("shutdown_timeout", previous.ShutdownTimeout, config.ShutdownTimeout)
+		changes[len(changes)-1] += requiresRestart
+	}
+	if config.StatementTimeout != previous.StatementTimeout {
+		changed("statement_timeout", previous.StatementTimeout, config.StatementTimeout)
+	}
+	if config.TLS != previous.TLS {
+		changed("tls", fmt.Sprintf("%+v", previous.TLS), fmt.Sprintf("%+v", config.TLS))
+		changes[len(changes)-1] += requiresRestart
+	}
+	if config.Tracing != previous.Tracing {
+		changed("tracing", fmt.Sprintf("%+v", previous.Tracing), fmt.Sprintf("%+v", config.Tracing))
+		changes[len(changes)-1] += requiresRestart
+	}
+	if strings.Join(config.CORS.AllowedOrigins, ",") != strings.Join(previous.CORS.AllowedOrigins, ",") {
+		changed("cors allowed_origins", previous.CORS.AllowedOrigins, config.CORS.AllowedOrigins)
+	}
+	oldLDAP, newLDAP := previous.LDAP, config.LDAP
+	oldLDAP.BindPassword, newLDAP.BindPassword = "", ""
+	if oldLDAP != newLDAP {
+		changed("ldap", fmt.Sprintf("%+v", oldLDAP), fmt.Sprintf("%+v", newLDAP))
+	}
+	if config.LDAP.BindPassword != previous.LDAP.BindPassword {
+		changes = append(changes, "ldap bind_password changed")
+	}
+	for name, source := range config.DataSources {
+		if old, ok := previous.DataSources[name]; !ok {
+			changes = append(changes, "datasource "+name+" added")
+		} else if old != source {
+			changes = append(changes, "datasource "+name+" changed")
+		}
+	}
+	for name := range previous.DataSources {
+		if _, ok := config.DataSources[name]; !ok {
+			changes = append(changes, "datasource "+name+" removed")
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+//returns the configuration with the settings that are only read when the server starts put back to
+//the ones it is running with, so that they are not reported as changed again on the next reload
+func (config Config) KeepStartupSettings(running Config) Config {
+	config.Port, config.JwtSecret, config.ShutdownTimeout = running.Port, running.JwtSecret, running.ShutdownTimeout
+	config.TLS, config.Tracing = running.TLS, running.Tracing
+	return config
+}
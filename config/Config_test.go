@@ -0,0 +1,58 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJwtSecretMustBeSet(t *testing.T) {
+	for _, secret := range []string{"", placeholderSecret} {
+		config := valid()
+		config.JwtSecret = secret
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "jwt_secret") {
+			t.Errorf("%q: got %v, want the jwt secret rejected", secret, err)
+		}
+	}
+	config := valid()
+	config.JwtSecret = "a real secret"
+	if err := config.Validate(); err != nil {
+		t.Errorf("got %v, want the configuration accepted", err)
+	}
+}
+
+//returns a configuration that passes Validate
+func valid() Config {
+	config := Default()
+	config.JwtSecret = "a real secret"
+	config.DataSources = map[string]DataSource{"Default": {Driver: "sqlite3", ConnectionString: "test.db"}}
+	return config
+}
+
+func TestDefaultDataSourceMustBeSet(t *testing.T) {
+	config := valid()
+	config.DataSources = map[string]DataSource{"warehouse": {Driver: "sqlite3", ConnectionString: "test.db"}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "named default") {
+		t.Errorf("got %v, want the missing default data source reported", err)
+	}
+}
+
+func TestChangesRequiringRestart(t *testing.T) {
+	previous := Default()
+	config := Default()
+	config.Port, config.LogLevel = "9090", "debug"
+	config.TLS.CertFile = "cert.pem"
+	changes := config.Changes(previous)
+	if len(changes) != 3 {
+		t.Fatalf("got changes %v, want 3", changes)
+	}
+	for _, change := range changes {
+		restart := strings.HasSuffix(change, requiresRestart)
+		if want := !strings.HasPrefix(change, "log_level"); restart != want {
+			t.Errorf("%q: got requires restart %v, want %v", change, restart, want)
+		}
+	}
+	kept := config.KeepStartupSettings(previous)
+	if changes := kept.Changes(previous); len(changes) != 1 {
+		t.Errorf("got changes %v after keeping the startup settings, want only the log level", changes)
+	}
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the name of the data source used when a request does not name one. The configuration must always have one
+const DefaultDataSource = "default"
+
+//the header that can be used to pick a data source instead of the {datasource} url segment
+const DataSourceHeader = "X-Data-Source"
+
+//this is where the named database connections are registered
+var dataSources = map[string]*DataSource{}
+var dataSourcesLock sync.RWMutex
+
+//names that can not be given to a data source because they would make the webservices urls ambiguous,
+//e.g. webservices/database/database/schema/table
+var reservedDataSourceNames = map[string]bool{"database": true}
+
+func checkDataSourceName(name string) error {
+	if name == "" || reservedDataSourceNames[strings.ToLower(name)] {
+		return errors.New("data source name " + name + " is reserved")
+	}
+	return nil
+}
+
+//registers a data source under a name so handlers can look it up, replacing any with the same name.
+//An error is returned if the name is reserved
+func AddDataSource(name string, source *DataSource) error {
+	if err := checkDataSourceName(name); err != nil {
+		return err
+	}
+	dataSourcesLock.Lock()
+	defer dataSourcesLock.Unlock()
+	dataSources[strings.ToLower(name)] = source
+	return nil
+}
+
+//returns the data source registered under the name
+func GetDataSource(name string) *DataSource {
+	source, err := TryGetDataSource(name)
+	if err != nil {
+		panic(err)
+	}
+	return source
+}
+
+//works the same way as GetDataSource but returns a not found error instead of panicking with it
+func TryGetDataSource(name string) (*DataSource, error) {
+	dataSourcesLock.RLock()
+	defer dataSourcesLock.RUnlock()
+	source, ok := dataSources[strings.ToLower(name)]
+	if !ok {
+		return nil, NotFoundError("data_source_not_found", "data source not recognised : "+name)
+	}
+	return source, nil
+}
+
+//returns the names of every registered data source in alphabetical order
+func DataSourceNames() []string {
+	dataSourcesLock.RLock()
+	defer dataSourcesLock.RUnlock()
+	names := make([]string, 0, len(dataSources))
+	for name := range dataSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//returns the data source a request asked for, either with a {datasource} segment in the route,
+//the X-Data-Source header or, if neither is passed, the default one
+func RequestDataSource(r *http.Request) *DataSource {
+	if name := mux.Vars(r)["datasource"]; name != "" {
+		return GetDataSource(name)
+	}
+	if name := r.Header.Get(DataSourceHeader); name != "" {
+		return GetDataSource(name)
+	}
+	return GetDataSource(DefaultDataSource)
+}
+
+//swaps the registered data sources for a new set in one go, so a request sees either all of the old
+//ones or all of the new ones. Sources whose driver and connection string have not changed are kept as they
+//are, even if they are not connected, as checkConnection reconnects them when they are next used. New or changed
+//ones are connected first and nothing is swapped if any of them fail.
+//The default data source is kept if the new set does not include one. The data sources that are no longer
+//used are never reconnected and their connections are closed after drain, so requests still using them can finish
+func ReplaceDataSources(sources map[string]*DataSource, drain time.Duration) error {
+	dataSourcesLock.RLock()
+	current := make(map[string]*DataSource, len(dataSources))
+	for name, source := range dataSources {
+		current[name] = source
+	}
+	dataSourcesLock.RUnlock()
+
+	replacement := make(map[string]*DataSource, len(sources)+1)
+	var opened []*DataSource
+	for name := range sources {
+		if err := checkDataSourceName(name); err != nil {
+			return err
+		}
+	}
+	for name, source := range sources {
+		name = strings.ToLower(name)
+		if existing, ok := current[name]; ok && existing.Driver == source.Driver && existing.ConnectionString == source.ConnectionString {
+			replacement[name] = existing
+			continue
+		}
+		if err := InitDB(source); err != nil {
+			for _, source := range opened {
+				source.retire().Close()
+			}
+			return errors.New("data source " + name + " : " + err.Error())
+		}
+		opened = append(opened, source)
+		replacement[name] = source
+	}
+	if existing, ok := current[DefaultDataSource]; ok && replacement[DefaultDataSource] == nil {
+		replacement[DefaultDataSource] = existing
+	}
+
+	dataSourcesLock.Lock()
+	dataSources = replacement
+	dataSourcesLock.Unlock()
+
+	for name, source := range current {
+		if replacement[name] == source {
+			continue
+		}
+		if connection := source.retire(); connection != nil {
+			time.AfterFunc(drain, func() { connection.Close() })
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReservedDataSourceNames(t *testing.T) {
+	source := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "test.db")}
+	for _, name := range []string{"database", "Database", ""} {
+		if err := AddDataSource(name, source); err == nil {
+			t.Errorf("%q: got no error, want the name rejected", name)
+		}
+		if _, err := TryGetDataSource(name); err == nil && name != "" {
+			t.Errorf("%q: got the data source registered", name)
+		}
+		if err := ReplaceDataSources(map[string]*DataSource{name: source}, 0); err == nil {
+			t.Errorf("%q: got no error replacing the data sources, want the name rejected", name)
+		}
+	}
+	if source.Connection != nil {
+		t.Error("got the data source connected, want it rejected before connecting")
+	}
+}
+
+func TestReplaceDataSourcesRetires(t *testing.T) {
+	old := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "old.db")}
+	if err := InitDB(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddDataSource("retired", old); err != nil {
+		t.Fatal(err)
+	}
+	replacement := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "new.db")}
+	if err := ReplaceDataSources(map[string]*DataSource{"retired": replacement}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer replacement.Pool().Close()
+	if source, _ := TryGetDataSource("retired"); source != replacement {
+		t.Error("got the old data source registered, want the replacement")
+	}
+	pool := old.Pool()
+	if err := pool.Ping(); err != nil {
+		t.Errorf("got %v, want the old pool left open for the requests still using it", err)
+	}
+	if err := old.reconnect(pool); err == nil {
+		t.Error("got the retired data source reconnected")
+	}
+	if old.Pool() != pool {
+		t.Error("got the retired data source's pool replaced")
+	}
+	pool.Close()
+}
+
+func TestCheckConnectionEndedContext(t *testing.T) {
+	source := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "test.db")}
+	if err := InitDB(source); err != nil {
+		t.Fatal(err)
+	}
+	pool := source.Pool()
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if err := checkConnection(ctx, source); !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want a timeout error", err)
+	}
+	if source.Pool() != pool {
+		t.Error("got the data source reconnected after the request's context ended")
+	}
+}
+
+//a data source that could not be connected when the server started is kept rather than failing the reload
+func TestReplaceDataSourcesKeepsUnconnected(t *testing.T) {
+	unconnected := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "missing", "test.db")}
+	if err := AddDataSource("unconnected", unconnected); err != nil {
+		t.Fatal(err)
+	}
+	same := &DataSource{Driver: unconnected.Driver, ConnectionString: unconnected.ConnectionString}
+	if err := ReplaceDataSources(map[string]*DataSource{"unconnected": same}, 0); err != nil {
+		t.Fatalf("got %v, want the unchanged data source kept", err)
+	}
+	if source, _ := TryGetDataSource("unconnected"); source != unconnected {
+		t.Error("got the data source replaced, want the existing one kept")
+	}
+}
@@ -2,30 +2,51 @@ package database
 
 import (
 	_ "github.com/denisenkom/go-mssqldb"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-oci8"
+	_ "github.com/mattn/go-sqlite3"
 	//_ "gopkg.in/rana/ora.v4"
 	//_ "gopkg.in/goracle.v2"
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
 	"net/url"
-	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 )
 
+//a database the handlers can run statements against. The driver can be oci8, mssql, postgres or sqlite3
+//and decides which Dialect the webservices use. Data sources are registered by name with AddDataSource
+//and looked up with GetDataSource, DefaultDataSource being the one used when a request does not name one
 type DataSource struct {
+	//the connection pool, which is replaced if the connection drops. Once the data source has been
+	//registered it should be read with Pool rather than directly
 	Connection       *sql.DB
 	Driver           string
 	ConnectionString string
+	//guards Connection and retired
+	lock sync.RWMutex
+	//set once the data source has been replaced so that it is never reconnected
+	retired bool
 }
 type Key int
 
-const JsonKey = "RandomKeyHere"
+//the key json web tokens are signed with, set from the configuration when the server starts
+var JsonKey string
 
 const MyKey Key = 0
 
+//the number of rows StreamGet and StreamFormat write between each flush to the client
+const StreamFlushRows = 500
+
 // JWT schema of the data it will store.
 type JwtData struct {
 	Username interface{} `json:"username"`
@@ -37,71 +58,197 @@ type ErrorResponse struct {
 	StackTrace  string
 	ErrorObject error
 }
-//this is where the database connections are declared
-var DatabaseConn = &DataSource{nil, "oci8", "username/password@ipAddress:port/databaseName"}
 
-//this function initialised the connections when the server starts
+//this function initialised the connections when the server starts. Any pool the data source already
+//had is closed once it has been replaced by the new one
 func InitDB(source *DataSource) error {
-	var err error
-	source.Connection, err = sql.Open(source.Driver, source.ConnectionString)
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	return source.open()
+}
+
+//opens a new connection pool in place of the current one. The lock must be held
+func (source *DataSource) open() error {
+	connection, err := sql.Open(source.Driver, source.ConnectionString)
 	if err != nil {
 		return err
 	}
-	source.Connection.SetMaxIdleConns(10)
-	if err = source.Connection.Ping(); err != nil {
+	connection.SetMaxIdleConns(10)
+	if err = connection.Ping(); err != nil {
+		connection.Close()
 		return err
 	}
+	if source.Connection != nil {
+		go source.Connection.Close()
+	}
+	source.Connection = connection
 	return nil
 }
 
-//this function runs a sql select statement to the passed data source and returns the response as a json array
+//returns the data source's connection pool, or nil if it has not been connected
+func (source *DataSource) Pool() *sql.DB {
+	source.lock.RLock()
+	defer source.lock.RUnlock()
+	return source.Connection
+}
+
+//opens a new pool in place of broken, the pool that was found not to work. Nothing is done if another
+//request has already replaced it, and a data source that has been retired is never reconnected
+func (source *DataSource) reconnect(broken *sql.DB) error {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.retired {
+		return errors.New("the data source has been replaced and can not be reconnected")
+	}
+	if source.Connection != broken {
+		return nil
+	}
+	return source.open()
+}
+
+//stops the data source from being reconnected and returns its connection pool so that it can be closed
+func (source *DataSource) retire() *sql.DB {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	source.retired = true
+	return source.Connection
+}
+
+//this function runs a sql select statement to the passed data source and returns the response as a json array.
+//Dates are written with ExportDateFormat
 func RunGet(sqlCommand string, source *DataSource, params ...interface{}) string {
-	tableData := GetQueryAsArray(sqlCommand, source, params...)
+	return RunGetContext(context.Background(), sqlCommand, source, params...)
+}
+
+//works the same way as RunGet but the statement is traced as part of ctx and cancelled when ctx ends
+func RunGetContext(ctx context.Context, sqlCommand string, source *DataSource, params ...interface{}) string {
+	jsonData, err := TryRunGet(ctx, sqlCommand, source, params...)
+	if err != nil {
+		panic(err)
+	}
+	return jsonData
+}
+
+//works the same way as RunGetContext but returns its errors instead of panicking with them
+func TryRunGet(ctx context.Context, sqlCommand string, source *DataSource, params ...interface{}) (string, error) {
+	tableData, err := TryGetQueryAsArray(ctx, sqlCommand, source, params...)
+	if err != nil {
+		return "", err
+	}
+	FormatDates(tableData)
 	jsonData, err := json.Marshal(tableData)
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		return "", InternalError(err)
 	}
-	return string(jsonData)
+	return string(jsonData), nil
 }
 
 //this function runs an insert/update/delete/etc statement to the passed data source
 func RunDataChange(sqlCommand string, source *sql.Tx, values ...interface{}) (sql.Result) {
-	stmt, err := source.Prepare(sqlCommand)
+	return RunDataChangeContext(context.Background(), sqlCommand, source, values...)
+}
+
+//works the same way as RunDataChange but the statement is traced as part of ctx and cancelled when ctx ends
+func RunDataChangeContext(ctx context.Context, sqlCommand string, source *sql.Tx, values ...interface{}) (sql.Result) {
+	res, err := TryRunDataChange(ctx, sqlCommand, source, values...)
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		panic(err)
 	}
-	res, err := stmt.Exec(values...)
+	return res
+}
+
+//works the same way as RunDataChangeContext but returns its errors instead of panicking with them
+func TryRunDataChange(ctx context.Context, sqlCommand string, source *sql.Tx, values ...interface{}) (res sql.Result, err error) {
+	defer observeQuery(ctx, "exec", time.Now(), &err)
+	stmt, err := prepare(ctx, source, sqlCommand)
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		return nil, err
 	}
-	stmt.Close()
-	return res
+	defer stmt.Close()
+	ctx, span := startSpan(ctx, "Exec", sqlCommand)
+	defer endSpan(span, &err)
+	if res, err = stmt.ExecContext(ctx, values...); err != nil {
+		return nil, statementError(ctx, err)
+	}
+	return res, nil
 }
 
+//begins a transaction and reads the posted json. The transaction is rolled back if the request ends, or its
+//route's timeout passes, before it is committed
 func GetPostData(r *http.Request, database *DataSource) (tx *sql.Tx, jwtData JwtData, postData map[string]interface{}, params []interface{}) {
-	jwtData, _ = r.Context().Value(MyKey).(JwtData)
 	var err error
-	if database.Connection == nil {
-		if err = InitDB(database); err != nil {
-			panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
-		}
+	if tx, jwtData, postData, params, err = TryGetPostData(r, database); err != nil {
+		panic(err)
 	}
-	if err = database.Connection.Ping(); err != nil {
-		if err = InitDB(database); err != nil {
-			panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
-		}
+	return
+}
+
+//works the same way as GetPostData but returns its errors instead of panicking with them
+func TryGetPostData(r *http.Request, database *DataSource) (tx *sql.Tx, jwtData JwtData, postData map[string]interface{}, params []interface{}, err error) {
+	jwtData, _ = r.Context().Value(MyKey).(JwtData)
+	if err = checkConnection(r.Context(), database); err != nil {
+		return
 	}
-	if tx, err = database.Connection.Begin(); err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+	if tx, _, err = begin(r.Context(), database); err != nil {
+		return nil, jwtData, nil, nil, statementError(r.Context(), err)
 	}
 	if err = json.NewDecoder(r.Body).Decode(&postData); err != nil {
 		if err.Error() != "EOF" {
-			panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+			tx.Rollback()
+			return nil, jwtData, nil, nil, invalidPostData(err)
 		}
+		err = nil
 	}
 	return
 }
 
+//works the same way as GetPostData but the post data can also be a json array of objects.
+//A single object is returned as an array of one and isArray reports which of the two was posted
+func GetPostDataArray(r *http.Request, database *DataSource) (tx *sql.Tx, jwtData JwtData, postData []map[string]interface{}, isArray bool, params []interface{}) {
+	var err error
+	if tx, jwtData, postData, isArray, params, err = TryGetPostDataArray(r, database); err != nil {
+		panic(err)
+	}
+	return
+}
+
+//works the same way as GetPostDataArray but returns its errors instead of panicking with them
+func TryGetPostDataArray(r *http.Request, database *DataSource) (tx *sql.Tx, jwtData JwtData, postData []map[string]interface{}, isArray bool, params []interface{}, err error) {
+	jwtData, _ = r.Context().Value(MyKey).(JwtData)
+	var body json.RawMessage
+	if err = checkConnection(r.Context(), database); err != nil {
+		return
+	}
+	if tx, _, err = begin(r.Context(), database); err != nil {
+		return nil, jwtData, nil, false, nil, statementError(r.Context(), err)
+	}
+	if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+		if err.Error() != "EOF" {
+			tx.Rollback()
+			return nil, jwtData, nil, false, nil, invalidPostData(err)
+		}
+		postData = []map[string]interface{}{nil}
+		return tx, jwtData, postData, false, nil, nil
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		isArray = true
+		err = json.Unmarshal(body, &postData)
+	} else {
+		var row map[string]interface{}
+		err = json.Unmarshal(body, &row)
+		postData = []map[string]interface{}{row}
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, jwtData, nil, false, nil, invalidPostData(err)
+	}
+	return
+}
+
+func invalidPostData(err error) *Error {
+	return ValidationError("invalid_json", "the posted json could not be read : "+err.Error())
+}
+
 func GetParameters(r *http.Request) (data map[string]string) {
 	data = mux.Vars(r)
 	for k := range data {
@@ -111,59 +258,258 @@ func GetParameters(r *http.Request) (data map[string]string) {
 	return
 }
 
-func GetQueryAsArray(sqlCommand string, source *DataSource, params ...interface{}) []map[string]interface{} {
-	if source.Connection == nil {
-		if err := InitDB(source); err != nil {
-			panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+//makes sure the data source has a working connection, reconnecting if it has dropped. Nothing is
+//reconnected when the ping only failed because ctx ended or for a reason a new pool would not fix
+func checkConnection(ctx context.Context, source *DataSource) error {
+	connection := source.Pool()
+	if connection != nil {
+		err := connection.PingContext(ctx)
+		if err == nil {
+			return nil
 		}
-	}
-	if err := source.Connection.Ping(); err != nil {
-		if err := InitDB(source); err != nil {
-			panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		if ctx.Err() != nil {
+			return statementError(ctx, ctx.Err())
+		}
+		if !isConnectionError(err) {
+			return UnavailableError("database_unavailable", "the database could not be reached", err)
 		}
 	}
-	tx, err := source.Connection.Begin()
+	if err := source.reconnect(connection); err != nil {
+		return UnavailableError("database_unavailable", "the database could not be reached", err)
+	}
+	return nil
+}
+
+func GetQueryAsArray(sqlCommand string, source *DataSource, params ...interface{}) []map[string]interface{} {
+	return GetQueryAsArrayContext(context.Background(), sqlCommand, source, params...)
+}
+
+//works the same way as GetQueryAsArray but the statement is traced as part of ctx and cancelled when ctx ends
+func GetQueryAsArrayContext(ctx context.Context, sqlCommand string, source *DataSource, params ...interface{}) []map[string]interface{} {
+	tableData, err := TryGetQueryAsArray(ctx, sqlCommand, source, params...)
+	if err != nil {
+		panic(err)
+	}
+	return tableData
+}
+
+//works the same way as GetQueryAsArrayContext but returns its errors instead of panicking with them
+func TryGetQueryAsArray(ctx context.Context, sqlCommand string, source *DataSource, params ...interface{}) ([]map[string]interface{}, error) {
+	if err := checkConnection(ctx, source); err != nil {
+		return nil, err
+	}
+	tx, cancel, err := begin(ctx, source)
+	if err != nil {
+		return nil, statementError(ctx, err)
+	}
+	defer cancel()
+	defer tx.Rollback()
+	tableData, err := TryGetTxQueryAsArray(ctx, sqlCommand, tx, params...)
+	if err != nil {
+		return nil, err
+	}
+	tx.Commit()
+	return tableData, nil
+}
+
+//runs a sql select statement that should find one row and returns it. The request fails with a not found
+//error, which matches ErrNotFound, if there is no row. Only the first row is returned if there are more
+func GetRowContext(ctx context.Context, sqlCommand string, source *DataSource, params ...interface{}) map[string]interface{} {
+	row, err := TryGetRow(ctx, sqlCommand, source, params...)
+	if err != nil {
+		panic(err)
+	}
+	return row
+}
+
+//works the same way as GetRowContext but returns its errors instead of panicking with them
+func TryGetRow(ctx context.Context, sqlCommand string, source *DataSource, params ...interface{}) (map[string]interface{}, error) {
+	tableData, err := TryGetQueryAsArray(ctx, sqlCommand, source, params...)
+	if err != nil {
+		return nil, err
+	}
+	return firstRow(tableData)
+}
+
+//this function works the same way as GetQueryAsArray but runs inside an open transaction, so it can
+//see rows that have been changed by the transaction but not committed yet
+func GetTxQueryAsArray(sqlCommand string, source *sql.Tx, params ...interface{}) []map[string]interface{} {
+	return GetTxQueryAsArrayContext(context.Background(), sqlCommand, source, params...)
+}
+
+//works the same way as GetTxQueryAsArray but the statement is traced as part of ctx and cancelled when ctx ends
+func GetTxQueryAsArrayContext(ctx context.Context, sqlCommand string, source *sql.Tx, params ...interface{}) []map[string]interface{} {
+	tableData, err := TryGetTxQueryAsArray(ctx, sqlCommand, source, params...)
+	if err != nil {
+		panic(err)
+	}
+	return tableData
+}
+
+//works the same way as GetTxQueryAsArrayContext but returns its errors instead of panicking with them
+func TryGetTxQueryAsArray(ctx context.Context, sqlCommand string, source *sql.Tx, params ...interface{}) (tableData []map[string]interface{}, err error) {
+	defer observeQuery(ctx, "query", time.Now(), &err)
+	stmt, err := prepare(ctx, source, sqlCommand)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	ctx, span := startSpan(ctx, "Query", sqlCommand)
+	defer endSpan(span, &err)
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, statementError(ctx, err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, statementError(ctx, err)
+	}
+	tableData = make([]map[string]interface{}, 0)
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	for rows.Next() {
+		tableData = append(tableData, scanRow(rows, columns, values, valuePtrs))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, statementError(ctx, err)
+	}
+	return tableData, nil
+}
+
+//works the same way as GetRowContext but runs inside an open transaction
+func GetTxRowContext(ctx context.Context, sqlCommand string, source *sql.Tx, params ...interface{}) map[string]interface{} {
+	row, err := TryGetTxRow(ctx, sqlCommand, source, params...)
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		panic(err)
 	}
+	return row
+}
+
+//works the same way as GetTxRowContext but returns its errors instead of panicking with them
+func TryGetTxRow(ctx context.Context, sqlCommand string, source *sql.Tx, params ...interface{}) (map[string]interface{}, error) {
+	tableData, err := TryGetTxQueryAsArray(ctx, sqlCommand, source, params...)
+	if err != nil {
+		return nil, err
+	}
+	return firstRow(tableData)
+}
+
+func firstRow(tableData []map[string]interface{}) (map[string]interface{}, error) {
+	if len(tableData) == 0 {
+		return nil, classify(sql.ErrNoRows)
+	}
+	return tableData[0], nil
+}
+
+//this function runs a sql select statement to the passed data source and writes the response to w as a
+//json array while the rows are being read, so large result sets never have to be held in memory.
+//Once the first row has been written the status can no longer be changed, so when the request is wrapped in
+//router.HandleError an error after that point aborts the response instead of being answered.
+func StreamGet(w io.Writer, sqlCommand string, source *DataSource, params ...interface{}) {
+	StreamFormatContext(context.Background(), w, FormatJSON, sqlCommand, source, params...)
+}
+
+//works the same way as StreamGet but the statement is traced as part of ctx and cancelled when ctx ends
+func StreamGetContext(ctx context.Context, w io.Writer, sqlCommand string, source *DataSource, params ...interface{}) {
+	StreamFormatContext(ctx, w, FormatJSON, sqlCommand, source, params...)
+}
+
+//this function works the same way as StreamGet but writes the rows in the passed export format
+func StreamFormat(w io.Writer, format string, sqlCommand string, source *DataSource, params ...interface{}) {
+	StreamFormatContext(context.Background(), w, format, sqlCommand, source, params...)
+}
+
+//works the same way as StreamFormat but the statement is traced as part of ctx and cancelled when ctx ends
+func StreamFormatContext(ctx context.Context, w io.Writer, format string, sqlCommand string, source *DataSource, params ...interface{}) {
+	if err := TryStreamFormat(ctx, w, format, sqlCommand, source, params...); err != nil {
+		panic(err)
+	}
+}
+
+//works the same way as StreamFormatContext but returns its errors instead of panicking with them
+func TryStreamFormat(ctx context.Context, w io.Writer, format string, sqlCommand string, source *DataSource, params ...interface{}) (err error) {
+	writer := NewRowWriter(format, w)
+	if err = checkConnection(ctx, source); err != nil {
+		return err
+	}
+	defer observeQuery(ctx, "stream", time.Now(), &err)
+	tx, cancel, err := begin(ctx, source)
+	if err != nil {
+		return statementError(ctx, err)
+	}
+	defer cancel()
 	defer tx.Rollback()
-	stmt, err := tx.Prepare(sqlCommand)
+	stmt, err := prepare(ctx, tx, sqlCommand)
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		return err
 	}
-	rows, err := stmt.Query(params...)
+	defer stmt.Close()
+	ctx, span := startSpan(ctx, "Query", sqlCommand)
+	defer endSpan(span, &err)
+	rows, err := stmt.QueryContext(ctx, params...)
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		return statementError(ctx, err)
 	}
 	defer rows.Close()
 	columns, err := rows.Columns()
 	if err != nil {
-		panic(ErrorResponse{err.Error(), string(debug.Stack()), err})
+		return statementError(ctx, err)
+	}
+	if err = writer.Begin(columns); err != nil {
+		return InternalError(err)
 	}
-	count := len(columns)
-	tableData := make([]map[string]interface{}, 0)
-	values := make([]interface{}, count)
-	valuePtrs := make([]interface{}, count)
+	flusher, _ := w.(http.Flusher)
+	values := make([]interface{}, len(columns))
+	valuePtrs := make([]interface{}, len(columns))
+	count := 0
 	for rows.Next() {
-		for i := 0; i < count; i++ {
-			valuePtrs[i] = &values[i]
+		if err = writer.Row(scanRow(rows, columns, values, valuePtrs)); err != nil {
+			return InternalError(err)
 		}
-		rows.Scan(valuePtrs...)
-		entry := make(map[string]interface{})
-		for i, col := range columns {
-			var v interface{}
-			val := values[i]
-			b, ok := val.([]byte)
-			if ok {
-				v = b
-			} else {
-				v = val
-			}
-			entry[col] = v
+		count++
+		if flusher != nil && count%StreamFlushRows == 0 {
+			flusher.Flush()
 		}
-		tableData = append(tableData, entry)
 	}
-	stmt.Close()
+	if err = rows.Err(); err != nil {
+		return statementError(ctx, err)
+	}
+	if err = writer.End(); err != nil {
+		return InternalError(err)
+	}
 	tx.Commit()
-	return tableData
+	return nil
+}
+
+//the error a statement returns when it fails, sorted in to unavailable, timeout, conflict and not found errors
+//where it can be. If ctx has ended the statement failed because it was cancelled, whatever the driver reports,
+//so the context's error is wrapped in so a passed timeout is answered with a 504
+func statementError(ctx context.Context, err error) *Error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		err = fmt.Errorf("%w : %v", ctxErr, err)
+	}
+	return classify(err)
+}
+
+//reads the current row in to a map of column names to values. values and valuePtrs are
+//passed in so that they can be reused for every row
+func scanRow(rows *sql.Rows, columns []string, values []interface{}, valuePtrs []interface{}) map[string]interface{} {
+	for i := range columns {
+		valuePtrs[i] = &values[i]
+	}
+	rows.Scan(valuePtrs...)
+	entry := make(map[string]interface{})
+	for i, col := range columns {
+		var v interface{}
+		val := values[i]
+		b, ok := val.([]byte)
+		if ok {
+			v = b
+		} else {
+			v = val
+		}
+		entry[col] = v
+	}
+	return entry
 }
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTryGetRow(t *testing.T) {
+	source := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "test.db")}
+	if err := InitDB(source); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Pool().Close()
+	if _, err := source.Pool().Exec(`CREATE TABLE PEOPLE (ID INTEGER PRIMARY KEY, NAME TEXT); INSERT INTO PEOPLE (NAME) VALUES ('Ann'), ('Bob')`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	row, err := TryGetRow(ctx, `SELECT NAME FROM PEOPLE WHERE ID = ?`, source, 2)
+	if err != nil || row["NAME"] != "Bob" {
+		t.Errorf("got %v %v, want Bob", row, err)
+	}
+	_, err = TryGetRow(ctx, `SELECT NAME FROM PEOPLE WHERE ID = ?`, source, 3)
+	var typed *Error
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &typed) || typed.Code != "row_not_found" {
+		t.Errorf("got %v, want a row_not_found error", err)
+	}
+}
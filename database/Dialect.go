@@ -0,0 +1,333 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+)
+
+//Dialect supplies the parts of a statement that differ between databases so that the same
+//webservices can run against any of them. Catalog queries return the sql with its parameters
+//and each must return the names it finds as a single column
+type Dialect interface {
+	//the placeholder for the nth parameter of a statement, counting from 1
+	Placeholder(n int) string
+	//the sql expression for the current date and time
+	CurrentTimestamp() string
+	//lists every schema
+	SchemasQuery() (string, []interface{})
+	//lists every table in a schema
+	TablesQuery(schema string) (string, []interface{})
+	//lists every column in a table
+	ColumnsQuery(schema string, table string) (string, []interface{})
+	//lists every sequence in a schema, or returns an empty string if the database has none
+	SequencesQuery(schema string) (string, []interface{})
+	//the sql expression for the next value of a sequence
+	NextSequenceValue(schema string, sequence string) string
+	//the clause that limits a select to a page of rows. ordered reports whether the select already has an order by
+	Paging(limit int, offset int, ordered bool) string
+	//the clauses that make an insert or update return the listed columns of the rows it changed as a
+	//result set. before goes in front of the values or where clause and after goes at the end of the
+	//statement. ok is false if the database can only return values through out parameters
+	Returning(columns string) (before string, after string, ok bool)
+	//reports whether the rows Returning gives back from a multi row insert come in the order of its values list.
+	//Where they may not, inserts whose ids or rows are needed put a single row in each statement
+	ReturnsInOrder() bool
+	//builds a statement that inserts a row or updates the existing one with the same key columns, stamping
+	//the CREATED_ or UPDATED_ columns to match. values holds the value for each column, id is the
+	//expression for a new id or an empty string if there is none and add binds a value and returns its placeholder
+	Upsert(table string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string
+	//builds a statement that inserts several rows at once. rows holds the value expressions of each row in the
+	//order of columns. The statement is split like Returning's clauses so that they can be put between the two parts
+	InsertRows(table string, columns []string, rows [][]string) (insert string, values string)
+}
+
+//returns the dialect for the data source's driver. Oracle is used for any driver that is not recognised
+func (source *DataSource) Dialect() Dialect {
+	switch source.Driver {
+	case "mssql", "sqlserver":
+		return SQLServer{}
+	case "postgres", "pgx":
+		return Postgres{}
+	case "sqlite3", "sqlite":
+		return SQLite{}
+	}
+	return Oracle{}
+}
+
+type Oracle struct{}
+
+func (Oracle) Placeholder(n int) string {
+	return ":v"
+}
+
+func (Oracle) CurrentTimestamp() string {
+	return "SYSDATE"
+}
+
+func (Oracle) SchemasQuery() (string, []interface{}) {
+	return `select DISTINCT username from dba_users`, nil
+}
+
+func (Oracle) TablesQuery(schema string) (string, []interface{}) {
+	return `SELECT DISTINCT OBJECT_NAME FROM DBA_OBJECTS WHERE OBJECT_TYPE = 'TABLE' AND OWNER = UPPER(:v)`, []interface{}{schema}
+}
+
+func (Oracle) ColumnsQuery(schema string, table string) (string, []interface{}) {
+	return `SELECT column_name FROM all_tab_cols WHERE owner = UPPER(:v) AND table_name = UPPER(:v)`, []interface{}{schema, table}
+}
+
+func (Oracle) SequencesQuery(schema string) (string, []interface{}) {
+	return `SELECT DISTINCT OBJECT_NAME FROM DBA_OBJECTS WHERE OBJECT_TYPE = 'SEQUENCE' AND OWNER = UPPER(:v)`, []interface{}{schema}
+}
+
+func (Oracle) NextSequenceValue(schema string, sequence string) string {
+	return schema + `.` + sequence + `.nextval`
+}
+
+func (Oracle) Paging(limit int, offset int, ordered bool) string {
+	return offsetFetch(limit, offset)
+}
+
+func (Oracle) Returning(columns string) (string, string, bool) {
+	return "", "", false
+}
+
+func (Oracle) ReturnsInOrder() bool {
+	return false
+}
+
+func (Oracle) Upsert(table string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string {
+	return merge(table+` t`, ` FROM dual) s`, "SYSDATE", keyColumns, valueColumns, values, username, id, add)
+}
+
+//oracle has no multi row values list so the rows are selected from dual instead
+func (Oracle) InsertRows(table string, columns []string, rows [][]string) (string, string) {
+	selects := make([]string, len(rows))
+	for i, row := range rows {
+		selects[i] = `SELECT ` + strings.Join(row, ", ") + ` FROM dual`
+	}
+	return `INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `)`, ` ` + strings.Join(selects, ` UNION ALL `)
+}
+
+type SQLServer struct{}
+
+func (SQLServer) Placeholder(n int) string {
+	return "@p" + strconv.Itoa(n)
+}
+
+func (SQLServer) CurrentTimestamp() string {
+	return "GETDATE()"
+}
+
+func (SQLServer) SchemasQuery() (string, []interface{}) {
+	return `SELECT name FROM sys.schemas`, nil
+}
+
+func (SQLServer) TablesQuery(schema string) (string, []interface{}) {
+	return `SELECT TABLE_NAME FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA = @p1`, []interface{}{schema}
+}
+
+func (SQLServer) ColumnsQuery(schema string, table string) (string, []interface{}) {
+	return `SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.COLUMNS WHERE TABLE_SCHEMA = @p1 AND TABLE_NAME = @p2`, []interface{}{schema, table}
+}
+
+func (SQLServer) SequencesQuery(schema string) (string, []interface{}) {
+	return `SELECT name FROM sys.sequences WHERE SCHEMA_NAME(schema_id) = @p1`, []interface{}{schema}
+}
+
+func (SQLServer) NextSequenceValue(schema string, sequence string) string {
+	return `NEXT VALUE FOR ` + schema + `.` + sequence
+}
+
+//sql server can only page an ordered select
+func (SQLServer) Paging(limit int, offset int, ordered bool) string {
+	if !ordered {
+		return ` ORDER BY (SELECT NULL)` + offsetFetch(limit, offset)
+	}
+	return offsetFetch(limit, offset)
+}
+
+func (SQLServer) Returning(columns string) (string, string, bool) {
+	columns = "INSERTED." + strings.Replace(columns, ", ", ", INSERTED.", -1)
+	return ` OUTPUT ` + columns, "", true
+}
+
+//OUTPUT makes no promise about the order of the rows it returns
+func (SQLServer) ReturnsInOrder() bool {
+	return false
+}
+
+func (SQLServer) Upsert(table string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string {
+	return merge(table+` AS t`, `) AS s`, "GETDATE()", keyColumns, valueColumns, values, username, id, add) + `;`
+}
+
+func (SQLServer) InsertRows(table string, columns []string, rows [][]string) (string, string) {
+	return valuesList(table, columns, rows)
+}
+
+type Postgres struct{}
+
+func (Postgres) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (Postgres) CurrentTimestamp() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (Postgres) SchemasQuery() (string, []interface{}) {
+	return `SELECT schema_name FROM information_schema.schemata`, nil
+}
+
+func (Postgres) TablesQuery(schema string) (string, []interface{}) {
+	return `SELECT table_name FROM information_schema.tables WHERE table_type = 'BASE TABLE' AND table_schema = lower($1)`, []interface{}{schema}
+}
+
+func (Postgres) ColumnsQuery(schema string, table string) (string, []interface{}) {
+	return `SELECT column_name FROM information_schema.columns WHERE table_schema = lower($1) AND table_name = lower($2)`, []interface{}{schema, table}
+}
+
+func (Postgres) SequencesQuery(schema string) (string, []interface{}) {
+	return `SELECT sequence_name FROM information_schema.sequences WHERE sequence_schema = lower($1)`, []interface{}{schema}
+}
+
+func (Postgres) NextSequenceValue(schema string, sequence string) string {
+	return `nextval('` + schema + `.` + sequence + `')`
+}
+
+func (Postgres) Paging(limit int, offset int, ordered bool) string {
+	return offsetFetch(limit, offset)
+}
+
+func (Postgres) Returning(columns string) (string, string, bool) {
+	return "", ` RETURNING ` + columns, true
+}
+
+func (Postgres) ReturnsInOrder() bool {
+	return true
+}
+
+func (Postgres) Upsert(table string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string {
+	return onConflict(table, "CURRENT_TIMESTAMP", keyColumns, valueColumns, values, username, id, add)
+}
+
+func (Postgres) InsertRows(table string, columns []string, rows [][]string) (string, string) {
+	return valuesList(table, columns, rows)
+}
+
+//sqlite has no schemas of its own so the attached databases (main, temp and any others) are used instead
+type SQLite struct{}
+
+func (SQLite) Placeholder(n int) string {
+	return "?"
+}
+
+func (SQLite) CurrentTimestamp() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (SQLite) SchemasQuery() (string, []interface{}) {
+	return `SELECT name FROM pragma_database_list`, nil
+}
+
+//the schema has already been checked against SchemasQuery so it is safe to put in to the sql
+func (SQLite) TablesQuery(schema string) (string, []interface{}) {
+	return `SELECT name FROM ` + schema + `.sqlite_master WHERE type = 'table'`, nil
+}
+
+func (SQLite) ColumnsQuery(schema string, table string) (string, []interface{}) {
+	return `SELECT name FROM pragma_table_info(?, ?)`, []interface{}{table, schema}
+}
+
+func (SQLite) SequencesQuery(schema string) (string, []interface{}) {
+	return "", nil
+}
+
+func (SQLite) NextSequenceValue(schema string, sequence string) string {
+	return ""
+}
+
+func (SQLite) Paging(limit int, offset int, ordered bool) string {
+	return ` LIMIT ` + strconv.Itoa(limit) + ` OFFSET ` + strconv.Itoa(offset)
+}
+
+func (SQLite) Returning(columns string) (string, string, bool) {
+	return "", ` RETURNING ` + columns, true
+}
+
+//sqlite returns the rows of a RETURNING clause in an arbitrary order
+func (SQLite) ReturnsInOrder() bool {
+	return false
+}
+
+func (SQLite) Upsert(table string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string {
+	return onConflict(table, "CURRENT_TIMESTAMP", keyColumns, valueColumns, values, username, id, add)
+}
+
+func (SQLite) InsertRows(table string, columns []string, rows [][]string) (string, string) {
+	return valuesList(table, columns, rows)
+}
+
+func offsetFetch(limit int, offset int) string {
+	return ` OFFSET ` + strconv.Itoa(offset) + ` ROWS FETCH NEXT ` + strconv.Itoa(limit) + ` ROWS ONLY`
+}
+
+//builds the multi row INSERT ... VALUES statement used by sql server, postgres and sqlite
+func valuesList(table string, columns []string, rows [][]string) (string, string) {
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		values[i] = `(` + strings.Join(row, ", ") + `)`
+	}
+	return `INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `)`, ` VALUES ` + strings.Join(values, ", ")
+}
+
+//builds the MERGE statement used by oracle and sql server
+func merge(target string, sourceEnd string, now string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string {
+	insertColumns := append(append([]string{}, keyColumns...), valueColumns...)
+	var sourceColumns, matches, updates, inserts []string
+	for _, columnName := range insertColumns {
+		sourceColumns = append(sourceColumns, add(values[columnName])+` `+columnName)
+		inserts = append(inserts, `s.`+columnName)
+	}
+	sourceColumns = append(sourceColumns, add(username)+` WEBSERVICES_USER`)
+	for _, columnName := range keyColumns {
+		matches = append(matches, `t.`+columnName+` = s.`+columnName)
+	}
+	for _, columnName := range valueColumns {
+		updates = append(updates, `t.`+columnName+` = s.`+columnName)
+	}
+	updates = append(updates, `t.UPDATED_DATE = `+now, `t.UPDATED_BY = s.WEBSERVICES_USER`)
+	insertList := `CREATED_DATE, CREATED_BY, `
+	insertValues := now + `, s.WEBSERVICES_USER, `
+	if id != "" {
+		insertList += `id, `
+		insertValues += id + `, `
+	}
+	return `MERGE INTO ` + target + ` USING (SELECT ` + strings.Join(sourceColumns, ", ") + sourceEnd +
+		` ON (` + strings.Join(matches, " AND ") + `)` +
+		` WHEN MATCHED THEN UPDATE SET ` + strings.Join(updates, ", ") +
+		` WHEN NOT MATCHED THEN INSERT (` + insertList + strings.Join(insertColumns, ", ") + `)` +
+		` VALUES (` + insertValues + strings.Join(inserts, ", ") + `)`
+}
+
+//builds the INSERT ... ON CONFLICT statement used by postgres and sqlite. The key columns
+//must have a unique constraint for the conflict to be detected
+func onConflict(table string, now string, keyColumns []string, valueColumns []string, values map[string]interface{}, username interface{}, id string, add func(value interface{}) string) string {
+	insertColumns := append(append([]string{}, keyColumns...), valueColumns...)
+	insertList := `CREATED_DATE, CREATED_BY, `
+	insertValues := now + `, ` + add(username) + `, `
+	if id != "" {
+		insertList += `id, `
+		insertValues += id + `, `
+	}
+	var placeholders, updates []string
+	for _, columnName := range insertColumns {
+		placeholders = append(placeholders, add(values[columnName]))
+	}
+	for _, columnName := range valueColumns {
+		updates = append(updates, columnName+` = EXCLUDED.`+columnName)
+	}
+	updates = append(updates, `UPDATED_DATE = `+now, `UPDATED_BY = EXCLUDED.CREATED_BY`)
+	return `INSERT INTO ` + table + ` (` + insertList + strings.Join(insertColumns, ", ") + `) VALUES (` + insertValues + strings.Join(placeholders, ", ") + `)` +
+		` ON CONFLICT (` + strings.Join(keyColumns, ", ") + `) DO UPDATE SET ` + strings.Join(updates, ", ")
+}
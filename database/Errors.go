@@ -0,0 +1,226 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/getsentry/raven-go"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+//the kinds of failure a request can end in, each answered with its own status code
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindValidation
+	KindNotFound
+	KindConflict
+	KindForbidden
+	KindUnavailable
+	KindUnauthorized
+	KindTimeout
+)
+
+//the status code requests failing with the kind of error are answered with
+func (kind ErrorKind) Status() int {
+	switch kind {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindUnavailable:
+		return http.StatusServiceUnavailable
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+//Error is the error handlers return, or panic with, to fail a request. Code is a stable machine readable
+//name for the failure, like column_not_recognised, and Message is shown to the caller along with any
+//InvalidParams. Err and StackTrace are only sent to Sentry and the logs
+type Error struct {
+	Kind          ErrorKind
+	Code          string
+	Message       string
+	InvalidParams []InvalidParam
+	Err           error
+	StackTrace    string
+}
+
+//a single parameter of a request that is not valid and the reason why
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+//errors returned by the database functions can be tested against these with errors.Is, which matches any *Error of the same kind
+var (
+	ErrUnavailable = &Error{Kind: KindUnavailable, Message: "the database could not be reached"}
+	ErrConflict    = &Error{Kind: KindConflict, Message: "the data clashes with data that already exists"}
+	ErrNotFound    = &Error{Kind: KindNotFound, Message: "not found"}
+	ErrTimeout     = &Error{Kind: KindTimeout, Message: "the statement took too long and was cancelled"}
+)
+
+//matches the kind sentinels above, which are the only errors without a code
+func (err *Error) Is(target error) bool {
+	sentinel, ok := target.(*Error)
+	return ok && sentinel.Code == "" && sentinel.Kind == err.Kind
+}
+
+//the message of the error that caused err, which the logs want rather than the message shown to the caller
+func statementCause(err error) string {
+	var typed *Error
+	if errors.As(err, &typed) && typed.Err != nil {
+		return typed.Err.Error()
+	}
+	return err.Error()
+}
+
+func newError(kind ErrorKind, code string, message string, cause error) *Error {
+	return &Error{Kind: kind, Code: code, Message: message, Err: cause, StackTrace: string(debug.Stack())}
+}
+
+//the request passed something that is not valid, like an unknown column
+func ValidationError(code string, message string) *Error {
+	return newError(KindValidation, code, message, nil)
+}
+
+//the request passed several parameters that are not valid, each listed with the reason why
+func InvalidParamsError(code string, message string, params []InvalidParam) *Error {
+	err := newError(KindValidation, code, message, nil)
+	err.InvalidParams = params
+	return err
+}
+
+//the request did not carry a valid token
+func UnauthorizedError(code string, message string) *Error {
+	return newError(KindUnauthorized, code, message, nil)
+}
+
+//the request asked for something that does not exist
+func NotFoundError(code string, message string) *Error {
+	return newError(KindNotFound, code, message, nil)
+}
+
+//the request clashes with data that already exists, like a duplicate key
+func ConflictError(code string, message string, cause error) *Error {
+	return newError(KindConflict, code, message, cause)
+}
+
+//the caller is not allowed to do what the request asked
+func ForbiddenError(code string, message string) *Error {
+	return newError(KindForbidden, code, message, nil)
+}
+
+//something the server depends on, like a database, could not be reached
+func UnavailableError(code string, message string, cause error) *Error {
+	return newError(KindUnavailable, code, message, cause)
+}
+
+//the request ran out of time before the database answered
+func TimeoutError(code string, message string, cause error) *Error {
+	return newError(KindTimeout, code, message, cause)
+}
+
+//anything else that went wrong. The cause is not shown to the caller
+func InternalError(cause error) *Error {
+	return newError(KindInternal, "internal_error", "internal server error", cause)
+}
+
+//turns an error, or any value a handler or job panicked with, in to an *Error. Database errors are sorted in to
+//unavailable, timeout, not found and conflict errors where they can be recognised and anything else, including runtime errors like
+//a nil map, becomes an internal error. When called while recovering the stack trace is the one that panicked
+func AsError(failure interface{}) *Error {
+	switch failure := failure.(type) {
+	case *Error:
+		return failure
+	case ErrorResponse:
+		err := failure.ErrorObject
+		if err == nil {
+			err = errors.New(failure.Error)
+		}
+		classified := classify(err)
+		classified.StackTrace = failure.StackTrace
+		return classified
+	case error:
+		var typed *Error
+		if errors.As(failure, &typed) {
+			return typed
+		}
+		return classify(failure)
+	}
+	return InternalError(fmt.Errorf("panic: %v", failure))
+}
+
+//sends the error to Sentry with its stack trace. tags and interfaces, like raven.NewHttp, add the context it happened in
+func (err *Error) Capture(tags map[string]string, interfaces ...raven.Interface) {
+	cause := err.Err
+	if cause == nil {
+		cause = errors.New(err.Message)
+	}
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags["code"] = err.Code
+	interfaces = append([]raven.Interface{raven.NewException(cause, raven.NewStacktrace(2, 3, nil))}, interfaces...)
+	raven.Capture(raven.NewPacketWithExtra(cause.Error(), raven.Extra{"stack_trace": err.StackTrace}, interfaces...), tags)
+}
+
+//the messages the supported databases use for unique, primary and foreign key violations
+var constraintMessages = []string{
+	"ORA-00001", "ORA-02291", "ORA-02292",
+	"Violation of UNIQUE KEY", "Violation of PRIMARY KEY", "conflicted with the FOREIGN KEY", "conflicted with the REFERENCE",
+	"duplicate key value", "violates foreign key constraint", "violates unique constraint",
+	"UNIQUE constraint failed", "FOREIGN KEY constraint failed",
+}
+
+//reports whether the error means the connection to the database was lost or could not be made
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.As(err, &netErr)
+}
+
+func classify(err error) *Error {
+	//checked first as the deadline error also counts as a net.Error
+	if errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError("statement_timeout", "the request took too long and was cancelled", err)
+	}
+	if isConnectionError(err) {
+		return UnavailableError("database_unavailable", "the database could not be reached", err)
+	}
+	if errors.Is(err, context.Canceled) {
+		return UnavailableError("request_cancelled", "the request was cancelled", err)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		notFound := NotFoundError("row_not_found", "no rows were found")
+		notFound.Err = err
+		return notFound
+	}
+	for _, message := range constraintMessages {
+		if strings.Contains(err.Error(), message) {
+			return ConflictError("constraint_violation", err.Error(), err)
+		}
+	}
+	return InternalError(err)
+}
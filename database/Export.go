@@ -0,0 +1,268 @@
+package database
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//the export formats that query results can be written in
+const (
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+	FormatXLSX   = "xlsx"
+)
+
+//dates are exported in a layout that ConvertToOracleDate accepts so exported data can be posted back
+const ExportDateFormat = "2006-01-02T15:04:05-07:00"
+
+//the content type sent for each export format
+var ContentTypes = map[string]string{
+	FormatJSON:   "application/json",
+	FormatNDJSON: "application/x-ndjson",
+	FormatCSV:    "text/csv",
+	FormatXLSX:   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+//writes query results out one row at a time in a particular export format
+type RowWriter interface {
+	Begin(columns []string) error
+	Row(entry map[string]interface{}) error
+	End() error
+}
+
+//works out which export format the client asked for. A format query parameter takes priority
+//over the Accept header and json is used when neither asks for a known format
+func RequestFormat(r *http.Request) string {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		if _, ok := ContentTypes[format]; !ok {
+			panic(ValidationError("unknown_format", "export format not recognised : "+format))
+		}
+		return format
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		for format, contentType := range ContentTypes {
+			if mediaType == contentType {
+				return format
+			}
+		}
+	}
+	return FormatJSON
+}
+
+//returns the row writer for the passed export format
+func NewRowWriter(format string, w io.Writer) RowWriter {
+	switch format {
+	case FormatJSON:
+		return &jsonRowWriter{w: w}
+	case FormatNDJSON:
+		return &ndjsonRowWriter{w: w}
+	case FormatCSV:
+		return &csvRowWriter{w: csv.NewWriter(w)}
+	case FormatXLSX:
+		return &xlsxRowWriter{zip: zip.NewWriter(w)}
+	}
+	panic(InternalError(errors.New("export format not recognised : " + format)))
+}
+
+//converts a value read from the database in to the text used by the csv and xlsx formats
+func exportValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return value.Format(ExportDateFormat)
+	case []byte:
+		return string(value)
+	}
+	return fmt.Sprint(value)
+}
+
+//formats the dates in query results with ExportDateFormat, so they come back the same way as the streamed
+//and exported results do and can be posted back as they are
+func FormatDates(tableData []map[string]interface{}) {
+	for _, entry := range tableData {
+		formatDates(entry)
+	}
+}
+
+//formats the dates in a row the same way exportValue does, for the json based formats
+func formatDates(entry map[string]interface{}) {
+	for column, value := range entry {
+		if t, ok := value.(time.Time); ok {
+			entry[column] = t.Format(ExportDateFormat)
+		}
+	}
+}
+
+type jsonRowWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (writer *jsonRowWriter) Begin(columns []string) error {
+	_, err := io.WriteString(writer.w, "[")
+	return err
+}
+
+func (writer *jsonRowWriter) Row(entry map[string]interface{}) error {
+	formatDates(entry)
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if writer.count > 0 {
+		if _, err = io.WriteString(writer.w, ","); err != nil {
+			return err
+		}
+	}
+	writer.count++
+	_, err = writer.w.Write(jsonData)
+	return err
+}
+
+func (writer *jsonRowWriter) End() error {
+	_, err := io.WriteString(writer.w, "]\n")
+	return err
+}
+
+type ndjsonRowWriter struct {
+	w io.Writer
+}
+
+func (writer *ndjsonRowWriter) Begin(columns []string) error {
+	return nil
+}
+
+func (writer *ndjsonRowWriter) Row(entry map[string]interface{}) error {
+	formatDates(entry)
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = writer.w.Write(append(jsonData, '\n'))
+	return err
+}
+
+func (writer *ndjsonRowWriter) End() error {
+	return nil
+}
+
+type csvRowWriter struct {
+	w       *csv.Writer
+	columns []string
+}
+
+func (writer *csvRowWriter) Begin(columns []string) error {
+	writer.columns = columns
+	return writer.w.Write(columns)
+}
+
+func (writer *csvRowWriter) Row(entry map[string]interface{}) error {
+	record := make([]string, len(writer.columns))
+	for i, column := range writer.columns {
+		record[i] = exportValue(entry[column])
+	}
+	return writer.w.Write(record)
+}
+
+func (writer *csvRowWriter) End() error {
+	writer.w.Flush()
+	return writer.w.Error()
+}
+
+//writes a workbook with a single sheet. The sheet is written first so the rows can be
+//streamed in to it and the rest of the workbook is added once it is finished
+type xlsxRowWriter struct {
+	zip     *zip.Writer
+	sheet   io.Writer
+	columns []string
+}
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+
+const xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+
+func (writer *xlsxRowWriter) Begin(columns []string) error {
+	var err error
+	writer.columns = columns
+	if writer.sheet, err = writer.zip.Create("xl/worksheets/sheet1.xml"); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(writer.sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return err
+	}
+	header := make([]interface{}, len(columns))
+	for i, column := range columns {
+		header[i] = column
+	}
+	return writer.writeRow(header)
+}
+
+func (writer *xlsxRowWriter) Row(entry map[string]interface{}) error {
+	values := make([]interface{}, len(writer.columns))
+	for i, column := range writer.columns {
+		values[i] = entry[column]
+	}
+	return writer.writeRow(values)
+}
+
+func (writer *xlsxRowWriter) writeRow(values []interface{}) error {
+	var row strings.Builder
+	row.WriteString("<row>")
+	for _, value := range values {
+		switch value.(type) {
+		case nil:
+			row.WriteString("<c/>")
+		case int64, float64:
+			row.WriteString("<c><v>" + exportValue(value) + "</v></c>")
+		default:
+			row.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(&row, []byte(exportValue(value)))
+			row.WriteString("</t></is></c>")
+		}
+	}
+	row.WriteString("</row>")
+	_, err := io.WriteString(writer.sheet, row.String())
+	return err
+}
+
+func (writer *xlsxRowWriter) End() error {
+	if _, err := io.WriteString(writer.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, file := range files {
+		f, err := writer.zip.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, file.content); err != nil {
+			return err
+		}
+	}
+	return writer.zip.Close()
+}
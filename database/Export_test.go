@@ -0,0 +1,195 @@
+package database
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//the number of rows in the streamed table, enough for two flushes
+const streamRows = 2*StreamFlushRows + 10
+
+//returns a sqlite data source with a PEOPLE table of streamRows rows, each born on the same date
+func newStreamDataSource(t *testing.T) *DataSource {
+	t.Helper()
+	source := &DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "test.db")}
+	if err := InitDB(source); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Pool().Close() })
+	for _, statement := range []string{
+		`CREATE TABLE PEOPLE (ID INTEGER PRIMARY KEY, NAME TEXT, BORN DATETIME)`,
+		`INSERT INTO PEOPLE (ID, NAME, BORN) WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < ?) SELECT i, 'person ' || i, ? FROM n`,
+	} {
+		if _, err := source.Pool().Exec(statement, streamRows, time.Date(2018, 12, 31, 10, 30, 0, 0, time.UTC)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+//records what is streamed to it along with how many bytes had been written at each flush.
+//Once failAfter flushes have happened every write fails, as it would if the client went away
+type flushRecorder struct {
+	body      bytes.Buffer
+	flushes   []int
+	failAfter int
+}
+
+func (recorder *flushRecorder) Write(data []byte) (int, error) {
+	if recorder.failAfter > 0 && len(recorder.flushes) >= recorder.failAfter {
+		return 0, errors.New("connection reset by peer")
+	}
+	return recorder.body.Write(data)
+}
+
+func (recorder *flushRecorder) Flush() {
+	recorder.flushes = append(recorder.flushes, recorder.body.Len())
+}
+
+func stream(t *testing.T, source *DataSource, format string) *flushRecorder {
+	t.Helper()
+	recorder := &flushRecorder{}
+	if err := TryStreamFormat(context.Background(), recorder, format, `SELECT * FROM PEOPLE ORDER BY ID`, source); err != nil {
+		t.Fatal(err)
+	}
+	return recorder
+}
+
+func TestStreamFlushes(t *testing.T) {
+	recorder := stream(t, newStreamDataSource(t), FormatJSON)
+	if len(recorder.flushes) != streamRows/StreamFlushRows {
+		t.Fatalf("got %d flushes, want one every %d rows", len(recorder.flushes), StreamFlushRows)
+	}
+	//the rows before each flush have already been written out in full
+	for _, written := range recorder.flushes {
+		if !strings.HasSuffix(string(recorder.body.Bytes()[:written]), "}") {
+			t.Errorf("got a flush after %d bytes partway through a row", written)
+		}
+	}
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(recorder.body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != streamRows || rows[0]["NAME"] != "person 1" || rows[0]["BORN"] != "2018-12-31T10:30:00+00:00" {
+		t.Errorf("got %d rows starting with %v", len(rows), rows[0])
+	}
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	recorder := stream(t, newStreamDataSource(t), FormatNDJSON)
+	scanner := bufio.NewScanner(&recorder.body)
+	count := 0
+	for scanner.Scan() {
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatalf("line %d: %v", count+1, err)
+		}
+		count++
+		if row["NAME"] != fmt.Sprintf("person %d", count) {
+			t.Errorf("line %d: got %v", count, row)
+		}
+		if row["BORN"] != "2018-12-31T10:30:00+00:00" {
+			t.Errorf("line %d: got date %v", count, row["BORN"])
+		}
+	}
+	if count != streamRows {
+		t.Errorf("got %d lines, want %d", count, streamRows)
+	}
+}
+
+func TestStreamCSV(t *testing.T) {
+	recorder := stream(t, newStreamDataSource(t), FormatCSV)
+	records, err := csv.NewReader(&recorder.body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != streamRows+1 {
+		t.Fatalf("got %d records, want a header and %d rows", len(records), streamRows)
+	}
+	if got := strings.Join(records[0], ","); got != "ID,NAME,BORN" {
+		t.Errorf("got header %s", got)
+	}
+	if got := strings.Join(records[1], ","); got != "1,person 1,2018-12-31T10:30:00+00:00" {
+		t.Errorf("got first row %s", got)
+	}
+}
+
+func TestStreamXLSX(t *testing.T) {
+	recorder := stream(t, newStreamDataSource(t), FormatXLSX)
+	workbook, err := zip.NewReader(bytes.NewReader(recorder.body.Bytes()), int64(recorder.body.Len()))
+	if err != nil {
+		t.Fatalf("got %v, want a valid zip", err)
+	}
+	files := map[string]*zip.File{}
+	for _, file := range workbook.File {
+		files[file.Name] = file
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"} {
+		if files[name] == nil {
+			t.Errorf("got no %s in the workbook", name)
+		}
+	}
+	sheet, err := files["xl/worksheets/sheet1.xml"].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sheet.Close()
+	var parsed struct {
+		Rows []struct {
+			Cells []struct {
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.NewDecoder(sheet).Decode(&parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Rows) != streamRows+1 {
+		t.Fatalf("got %d rows, want a header and %d rows", len(parsed.Rows), streamRows)
+	}
+	first := parsed.Rows[1].Cells
+	if first[0].Value != "1" || first[1].Inline != "person 1" || first[2].Inline != "2018-12-31T10:30:00+00:00" {
+		t.Errorf("got first row %+v", first)
+	}
+}
+
+//a client that goes away partway through leaves a partial response and the stream ends with an error
+func TestStreamAbort(t *testing.T) {
+	recorder := &flushRecorder{failAfter: 1}
+	err := TryStreamFormat(context.Background(), recorder, FormatJSON, `SELECT * FROM PEOPLE ORDER BY ID`, newStreamDataSource(t))
+	if err == nil {
+		t.Fatal("got no error, want the failed write reported")
+	}
+	if len(recorder.flushes) != 1 || recorder.body.Len() != recorder.flushes[0] {
+		t.Errorf("got %d bytes after flushes at %v, want nothing written after the first", recorder.body.Len(), recorder.flushes)
+	}
+	if body := recorder.body.String(); !strings.HasPrefix(body, "[") || strings.HasSuffix(strings.TrimSpace(body), "]") {
+		t.Errorf("got a complete array, want it cut off")
+	}
+}
+
+//a statement that runs out of time before the first row is answered with a timeout
+func TestStreamTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	recorder := &flushRecorder{}
+	err := TryStreamFormat(ctx, recorder, FormatJSON, `SELECT * FROM PEOPLE`, newStreamDataSource(t))
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got %v, want a timeout", err)
+	}
+	if recorder.body.Len() != 0 {
+		t.Errorf("got %q written, want nothing", recorder.body.String())
+	}
+}
@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+//the result of pinging a data source along with the statistics of its connection pool
+type DataSourceHealth struct {
+	Name  string
+	Ready bool
+	Error string `json:",omitempty"`
+	Pool  sql.DBStats
+}
+
+//pings every registered data source at the same time and returns the results in the order of DataSourceNames.
+//ctx limits how long the pings can take. Data sources removed by a reload while the names are read are left out
+func CheckDataSources(ctx context.Context) []DataSourceHealth {
+	names := DataSourceNames()
+	sources := make([]*DataSource, 0, len(names))
+	results := make([]DataSourceHealth, 0, len(names))
+	for _, name := range names {
+		if source, err := TryGetDataSource(name); err == nil {
+			sources = append(sources, source)
+			results = append(results, DataSourceHealth{Name: name})
+		}
+	}
+	var wait sync.WaitGroup
+	for i := range results {
+		wait.Add(1)
+		go func(result *DataSourceHealth, source *DataSource) {
+			defer wait.Done()
+			connection := source.Pool()
+			if connection == nil {
+				result.Error = "not connected"
+				return
+			}
+			result.Pool = connection.Stats()
+			if err := connection.PingContext(ctx); err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.Ready = true
+		}(&results[i], sources[i])
+	}
+	wait.Wait()
+	return results
+}
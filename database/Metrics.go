@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"github.com/hunter7654/go-api/logging"
+	"github.com/hunter7654/go-api/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+func init() {
+	prometheus.MustRegister(poolCollector{})
+}
+
+//records how long a statement took and whether it failed, logging it at debug level. Failures are only logged
+//at a higher level once, by the request that ends with them. It has to be deferred with a pointer to the error
+//the statement returns so that it sees the final value
+func observeQuery(ctx context.Context, operation string, start time.Time, err *error) {
+	elapsed := time.Since(start)
+	metrics.ObserveQuery(operation, elapsed, *err != nil)
+	logger := logging.FromContext(ctx)
+	if *err != nil {
+		logger.Debug("statement failed", "operation", operation, "seconds", elapsed.Seconds(), "error", statementCause(*err))
+	} else {
+		logger.Debug("statement", "operation", operation, "seconds", elapsed.Seconds())
+	}
+}
+
+var (
+	poolLabels      = []string{"datasource"}
+	poolMaxOpen     = prometheus.NewDesc(metrics.Namespace+"_db_pool_max_open_connections", "The most connections the pool can open.", poolLabels, nil)
+	poolOpen        = prometheus.NewDesc(metrics.Namespace+"_db_pool_open_connections", "The connections open, in use and idle.", poolLabels, nil)
+	poolInUse       = prometheus.NewDesc(metrics.Namespace+"_db_pool_in_use_connections", "The connections in use.", poolLabels, nil)
+	poolIdle        = prometheus.NewDesc(metrics.Namespace+"_db_pool_idle_connections", "The idle connections.", poolLabels, nil)
+	poolWaits       = prometheus.NewDesc(metrics.Namespace+"_db_pool_wait_count_total", "The number of times a connection had to be waited for.", poolLabels, nil)
+	poolWaitSeconds = prometheus.NewDesc(metrics.Namespace+"_db_pool_wait_duration_seconds_total", "The time spent waiting for connections.", poolLabels, nil)
+)
+
+//reports the sql.DB statistics of every registered data source each time the metrics are scraped
+type poolCollector struct{}
+
+func (poolCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	for _, description := range []*prometheus.Desc{poolMaxOpen, poolOpen, poolInUse, poolIdle, poolWaits, poolWaitSeconds} {
+		descriptions <- description
+	}
+}
+
+func (poolCollector) Collect(collected chan<- prometheus.Metric) {
+	for _, name := range DataSourceNames() {
+		//a reload can remove the data source after the names were read
+		source, err := TryGetDataSource(name)
+		if err != nil {
+			continue
+		}
+		connection := source.Pool()
+		if connection == nil {
+			continue
+		}
+		stats := connection.Stats()
+		collected <- prometheus.MustNewConstMetric(poolMaxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections), name)
+		collected <- prometheus.MustNewConstMetric(poolOpen, prometheus.GaugeValue, float64(stats.OpenConnections), name)
+		collected <- prometheus.MustNewConstMetric(poolInUse, prometheus.GaugeValue, float64(stats.InUse), name)
+		collected <- prometheus.MustNewConstMetric(poolIdle, prometheus.GaugeValue, float64(stats.Idle), name)
+		collected <- prometheus.MustNewConstMetric(poolWaits, prometheus.CounterValue, float64(stats.WaitCount), name)
+		collected <- prometheus.MustNewConstMetric(poolWaitSeconds, prometheus.CounterValue, stats.WaitDuration.Seconds(), name)
+	}
+}
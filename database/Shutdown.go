@@ -0,0 +1,50 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+//every transaction is begun with this context so that cancelling it rolls back the ones still open
+var transactionContext, cancelTransactions = context.WithCancel(context.Background())
+
+//begins a transaction that is rolled back when ctx ends, such as when the client disconnects or the route's
+//timeout passes, or by RollbackTransactions if it is still open when the server shuts down. cancel should be
+//called once the transaction is finished with unless ctx is a request's context, which ends by itself
+func begin(ctx context.Context, source *DataSource) (tx *sql.Tx, cancel context.CancelFunc, err error) {
+	ctx, cancel = context.WithCancel(ctx)
+	stop := context.AfterFunc(transactionContext, cancel)
+	context.AfterFunc(ctx, func() { stop() })
+	if tx, err = source.Pool().BeginTx(ctx, nil); err != nil {
+		cancel()
+	}
+	return
+}
+
+//rolls back every transaction that has not been committed. Any transaction begun afterwards fails
+//straight away so this should only be called when the server is shutting down
+func RollbackTransactions() {
+	cancelTransactions()
+}
+
+//closes the connection pool of every registered data source. They are not reconnected afterwards
+func CloseDataSources() error {
+	dataSourcesLock.RLock()
+	defer dataSourcesLock.RUnlock()
+	var problems []string
+	for name, source := range dataSources {
+		connection := source.retire()
+		if connection == nil {
+			continue
+		}
+		if err := connection.Close(); err != nil {
+			problems = append(problems, name+" : "+err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("data sources not closed : " + strings.Join(problems, ", "))
+	}
+	return nil
+}
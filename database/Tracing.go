@@ -0,0 +1,38 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//the name the database spans are recorded under
+const tracerName = "github.com/hunter7654/go-api/database"
+
+//starts a child span of ctx for a single Prepare, Query or Exec of a statement
+func startSpan(ctx context.Context, operation string, sqlCommand string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("db.statement", sqlCommand)))
+}
+
+//ends a span started with startSpan. It has to be deferred with a pointer to the error the statement
+//returns so that a failure is recorded on the span
+func endSpan(span trace.Span, err *error) {
+	if *err != nil {
+		span.SetStatus(codes.Error, statementCause(*err))
+		span.RecordError(*err)
+	}
+	span.End()
+}
+
+//prepares a statement inside a transaction in its own span
+func prepare(ctx context.Context, tx *sql.Tx, sqlCommand string) (stmt *sql.Stmt, err error) {
+	ctx, span := startSpan(ctx, "Prepare", sqlCommand)
+	defer endSpan(span, &err)
+	if stmt, err = tx.PrepareContext(ctx, sqlCommand); err != nil {
+		return nil, statementError(ctx, err)
+	}
+	return stmt, nil
+}
@@ -1,15 +1,22 @@
 package routes
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/query"
 	"github.com/hunter7654/go-api/router"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func init() {
 	router.AddAuth(router.Route{Method: "POST", Pattern: "/examplepost", HandlerFunc: ExamplePost})
 	router.AddDef(router.Route{Method: "GET", Pattern: "/exampleget/{id}/{test}", HandlerFunc: ExampleGet})
+	//large streams can take longer than the statement_timeout setting so this route sets its own
+	router.AddDef(router.Route{Method: "GET", Pattern: "/examplestream/{id}", HandlerFunc: ExampleStream, Timeout: 10 * time.Minute})
+	router.AddAuth(router.Route{Method: "GET", Pattern: "/examplefilter/{json}", HandlerFunc: router.Handle(ExampleFilter)})
 }
 
 type exampleStruct struct {
@@ -23,15 +30,53 @@ func ExampleGet(w http.ResponseWriter, r *http.Request) {
 	jwtData, _ := r.Context().Value(database.MyKey).(database.JwtData)
 	sql := `Enter select statement here`
 	data := database.GetParameters(r)
-	fmt.Fprintln(w, database.RunGet(sql, database.DatabaseConn, data["id"], data["test"], jwtData.Username))
+	fmt.Fprintln(w, database.RunGetContext(r.Context(), sql, database.GetDataSource(database.DefaultDataSource), data["id"], data["test"], jwtData.Username))
+}
+
+//this is an example route to show how to stream a large get request to the client as it is read
+func ExampleStream(w http.ResponseWriter, r *http.Request) {
+	sql := `Enter select statement here`
+	data := database.GetParameters(r)
+	database.StreamGetContext(r.Context(), w, sql, database.GetDataSource(database.DefaultDataSource), data["id"])
+}
+
+//this is an example route to show how to let the caller filter a get request using the same
+//"COL:comparator" json as the webservices. It returns its errors, which router.Handle answers with their status code
+func ExampleFilter(w http.ResponseWriter, r *http.Request) error {
+	jwtData, _ := r.Context().Value(database.MyKey).(database.JwtData)
+	var filter map[string]interface{}
+	data := database.GetParameters(r)
+	if err := json.Unmarshal([]byte(data["json"]), &filter); err != nil {
+		return database.ValidationError("invalid_json", "the json in the url could not be read : "+err.Error())
+	}
+	//column names go straight in to the sql so only allow the ones you expect
+	allowedColumns := map[string]bool{"EXAMPLE_ID": true, "EXAMPLE_NAME": true}
+	for _, column := range query.Columns(filter) {
+		if !allowedColumns[strings.ToUpper(column)] {
+			return database.ValidationError("column_not_recognised", "column name not recognised : "+column)
+		}
+	}
+	//uses the data source named in the X-Data-Source header, use database.GetDataSource to pick one by name
+	source := database.RequestDataSource(r)
+	params := query.NewParams(source)
+	sql := `Enter select statement here`
+	where, err := query.Where(filter, params, jwtData.Username)
+	if err != nil {
+		return err
+	}
+	if where != "" {
+		sql += ` WHERE ` + where
+	}
+	fmt.Fprintln(w, database.RunGetContext(r.Context(), sql, source, params.Values...))
+	return nil
 }
 
 //this is an example route to show how to handle a post request
 func ExamplePost(w http.ResponseWriter, r *http.Request) {
-	tx, jwtData, postData, params := database.GetPostData(r, database.DatabaseConn)
+	tx, jwtData, postData, params := database.GetPostData(r, database.GetDataSource(database.DefaultDataSource))
 	defer tx.Rollback()
 	sql := `Enter Insert Statement Here`
 	params = append(params, "Attach Params Here", jwtData.Username, postData["data"])
-	fmt.Fprintln(w, database.RunDataChange(sql, tx, params...))
+	fmt.Fprintln(w, database.RunDataChangeContext(r.Context(), sql, tx, params...))
 	tx.Commit()
 }
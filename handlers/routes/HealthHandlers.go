@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/router"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+//how long /readyz waits for the data sources and ldap server to answer
+const readinessTimeout = 5 * time.Second
+
+func init() {
+	router.AddDef(router.Route{Method: "GET", Pattern: "/healthz", HandlerFunc: Healthz})
+	router.AddDef(router.Route{Method: "GET", Pattern: "/readyz", HandlerFunc: Readyz})
+	router.AddAuth(router.Route{Method: "GET", Pattern: "/readyz/detail", HandlerFunc: ReadyzDetail})
+	router.AddDef(router.Route{Method: "GET", Pattern: "/metrics", HandlerFunc: promhttp.Handler().ServeHTTP})
+}
+
+type readiness struct {
+	Ready       bool
+	DataSources []database.DataSourceHealth `json:",omitempty"`
+	LDAP        *ldapHealth                 `json:",omitempty"`
+}
+
+type ldapHealth struct {
+	Ready bool
+	Error string `json:",omitempty"`
+}
+
+//reports that the process is running and able to answer requests
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"Alive": true})
+}
+
+//reports whether every data source, and the ldap server if check_readiness is set, can be reached.
+//Answers with 503 if any of them can not
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	status := checkReadiness(r.Context())
+	writeReadiness(w, readiness{Ready: status.Ready})
+}
+
+//works the same way as Readyz but also lists each check with its error and the data source pool statistics.
+//The errors can name hosts and users so the route needs a token
+func ReadyzDetail(w http.ResponseWriter, r *http.Request) {
+	writeReadiness(w, checkReadiness(r.Context()))
+}
+
+func checkReadiness(ctx context.Context) readiness {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	status := readiness{Ready: true, DataSources: database.CheckDataSources(ctx)}
+	for _, source := range status.DataSources {
+		status.Ready = status.Ready && source.Ready
+	}
+	if settings := currentLDAPSettings(); settings.CheckReadiness {
+		status.LDAP = checkLDAP(ctx)
+		status.Ready = status.Ready && status.LDAP.Ready
+	}
+	return status
+}
+
+//connects to the ldap server without logging in
+func checkLDAP(ctx context.Context) *ldapHealth {
+	connected := make(chan error, 1)
+	go func() {
+		client := ldapClient(currentLDAPSettings())
+		defer client.Close()
+		connected <- client.Connect()
+	}()
+	select {
+	case err := <-connected:
+		if err != nil {
+			return &ldapHealth{Error: err.Error()}
+		}
+		return &ldapHealth{Ready: true}
+	case <-ctx.Done():
+		return &ldapHealth{Error: ctx.Err().Error()}
+	}
+}
+
+func writeReadiness(w http.ResponseWriter, status readiness) {
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -1,12 +1,13 @@
 package routes
 
 import (
+	"github.com/hunter7654/go-api/config"
 	"github.com/hunter7654/go-api/database"
 	"github.com/hunter7654/go-api/router"
 	"encoding/json"
 	"github.com/jtblin/go-ldap-client"
 	"net/http"
-	"runtime/debug"
+	"sync"
 )
 
 type loginStruct struct {
@@ -33,7 +34,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	var loginParams loginStruct
 	err := json.NewDecoder(r.Body).Decode(&loginParams)
 	if err != nil {
-		panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack()), ErrorObject: err})
+		panic(database.ValidationError("invalid_json", "the login could not be read : "+err.Error()))
 	}
 	ok, username := Authenticate(loginParams.Username, loginParams.Password)
 	if ok {
@@ -42,22 +43,45 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write(response)
 	} else {
-		http.Error(w, "Incorrect Username/password", http.StatusUnauthorized)
+		router.WriteError(w, r, database.UnauthorizedError("invalid_login", "Incorrect Username/password"))
+	}
+}
+
+//the ldap server logins are checked against, set from the configuration with SetLDAPSettings
+var ldapSettings config.LDAP
+var ldapSettingsLock sync.RWMutex
+
+//changes the ldap server logins are checked against. Logins that have already started finish with the old settings
+func SetLDAPSettings(settings config.LDAP) {
+	ldapSettingsLock.Lock()
+	defer ldapSettingsLock.Unlock()
+	ldapSettings = settings
+}
+
+func currentLDAPSettings() config.LDAP {
+	ldapSettingsLock.RLock()
+	defer ldapSettingsLock.RUnlock()
+	return ldapSettings
+}
+
+//builds a client for the ldap server logins are checked against
+func ldapClient(settings config.LDAP) *ldap.LDAPClient {
+	return &ldap.LDAPClient{
+		Base:         settings.Base,
+		Host:         settings.Host,
+		Port:         settings.Port,
+		UseSSL:       settings.UseSSL,
+		BindDN:       settings.BindDN,
+		BindPassword: settings.BindPassword,
+		UserFilter:   settings.UserFilter,
+		Attributes:   []string{settings.UsernameAttribute},
 	}
 }
 
 // LDAP auth
 func Authenticate(username string, password string) (bool, string) {
-	client := &ldap.LDAPClient{
-		Base:         "",
-		Host:         "",
-		Port:         0,
-		UseSSL:       false,
-		BindDN:       "",
-		BindPassword: "",
-		UserFilter:   "",
-		Attributes:   []string{""},
-	}
+	settings := currentLDAPSettings()
+	client := ldapClient(settings)
 	defer client.Close()
 	ok, user, err := client.Authenticate(username, password)
 	if err != nil {
@@ -66,5 +90,5 @@ func Authenticate(username string, password string) (bool, string) {
 	if !ok {
 		return false, ""
 	}
-	return true, user[""]
+	return true, user[settings.UsernameAttribute]
 }
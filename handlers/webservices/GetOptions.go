@@ -0,0 +1,180 @@
+package webservices
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/hunter7654/go-api/database"
+	"strconv"
+	"strings"
+)
+
+//the options that can be passed to the get webservice alongside the where parameters
+type getOptions struct {
+	Columns        []string
+	OrderBy        []string
+	Limit          int
+	Offset         int
+	IncludeDeleted bool
+	Stream         bool
+}
+
+//the response returned by the get webservice when a limit is passed
+type pageResponse struct {
+	Total         int                      `json:"total"`
+	NextPageToken string                   `json:"next_page_token,omitempty"`
+	Data          []map[string]interface{} `json:"data"`
+}
+
+//takes the option keys out of the posted json so that only columns are left in it
+func parseGetOptions(postData map[string]interface{}) (options getOptions, err error) {
+	options.IncludeDeleted, _ = postData["include_deleted"].(bool)
+	options.Stream, _ = postData["stream"].(bool)
+	if options.Columns, err = stringList(postData["columns"], "columns"); err != nil {
+		return
+	}
+	if options.OrderBy, err = stringList(postData["order_by"], "order_by"); err != nil {
+		return
+	}
+	for _, order := range options.OrderBy {
+		if split := strings.Split(order, ":"); len(split) > 1 && strings.ToLower(split[1]) != "asc" && strings.ToLower(split[1]) != "desc" {
+			return options, database.ValidationError("unknown_sort_direction", "Unknown sort direction : "+order)
+		}
+	}
+	if options.Limit, err = positiveInt(postData["limit"], "limit"); err != nil {
+		return
+	}
+	if options.Offset, err = positiveInt(postData["offset"], "offset"); err != nil {
+		return
+	}
+	if token, ok := postData["page_token"].(string); ok && token != "" {
+		if options.Offset, err = decodePageToken(token); err != nil {
+			return
+		}
+	}
+	if options.Offset > 0 && options.Limit == 0 {
+		return options, database.ValidationError("missing_limit", "offset and page_token can only be used with a limit")
+	}
+	for _, key := range []string{"include_deleted", "stream", "columns", "order_by", "limit", "offset", "page_token"} {
+		delete(postData, key)
+	}
+	return
+}
+
+//returns the column names used by the columns and order_by options so they can be validated
+func (options getOptions) columnNames() (columns []string) {
+	columns = append(columns, options.Columns...)
+	for _, order := range options.OrderBy {
+		columns = append(columns, strings.Split(order, ":")[0])
+	}
+	return
+}
+
+//builds the select list from the columns option
+func (options getOptions) selectList() string {
+	if len(options.Columns) == 0 {
+		return "*"
+	}
+	return strings.Join(options.Columns, ", ")
+}
+
+//builds the order by clause from the order_by option. Each entry is a column name
+//optionally followed by :asc or :desc, which parseGetOptions has already checked
+func (options getOptions) orderByClause() string {
+	if len(options.OrderBy) == 0 {
+		return ""
+	}
+	var orders []string
+	for _, order := range options.OrderBy {
+		split := strings.Split(order, ":")
+		if len(split) == 1 {
+			orders = append(orders, split[0])
+			continue
+		}
+		orders = append(orders, split[0]+" "+strings.ToUpper(split[1]))
+	}
+	return " ORDER BY " + strings.Join(orders, ", ")
+}
+
+//builds the paging clause from the limit and offset options
+func (options getOptions) pagingClause(dialect database.Dialect) string {
+	if options.Limit == 0 {
+		return ""
+	}
+	return dialect.Paging(options.Limit, options.Offset, len(options.OrderBy) > 0)
+}
+
+//returns the token for the page after the current one or an empty string if this is the last page
+func (options getOptions) nextPageToken(total int) string {
+	next := options.Offset + options.Limit
+	if next >= total {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(next)))
+}
+
+func decodePageToken(token string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, database.ValidationError("invalid_page_token", "page_token not recognised")
+	}
+	offset, err := strconv.Atoi(string(decoded))
+	if err != nil || offset < 0 {
+		return 0, database.ValidationError("invalid_page_token", "page_token not recognised")
+	}
+	return offset, nil
+}
+
+//accepts either a json array of strings or a comma separated string
+func stringList(value interface{}, name string) (list []string, err error) {
+	switch value := value.(type) {
+	case nil:
+	case string:
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			stringItem, ok := item.(string)
+			if !ok {
+				return nil, database.ValidationError("invalid_"+name, name+" must only contain strings")
+			}
+			list = append(list, strings.TrimSpace(stringItem))
+		}
+	default:
+		return nil, database.ValidationError("invalid_"+name, name+" must be an array or a comma separated string")
+	}
+	return
+}
+
+func positiveInt(value interface{}, name string) (int, error) {
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		if value >= 0 && value == float64(int(value)) {
+			return int(value), nil
+		}
+	}
+	return 0, database.ValidationError("invalid_"+name, name+" must be a positive whole number")
+}
+
+//converts a number returned from the database in to an int
+func toInt(value interface{}) int {
+	switch value := value.(type) {
+	case int64:
+		return int(value)
+	case float64:
+		return int(value)
+	case string:
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	case []byte:
+		if i, err := strconv.Atoi(string(value)); err == nil {
+			return i
+		}
+	}
+	panic(database.InternalError(fmt.Errorf("number type not recognised : %T", value)))
+}
@@ -0,0 +1,115 @@
+package webservices
+
+import (
+	"errors"
+	"github.com/hunter7654/go-api/database"
+	"reflect"
+	"testing"
+)
+
+func TestParseGetOptions(t *testing.T) {
+	postData := map[string]interface{}{
+		"NAME:=":          "Ann",
+		"columns":         "ID, NAME",
+		"order_by":        []interface{}{"NAME:desc", "ID"},
+		"limit":           10.0,
+		"offset":          5.0,
+		"include_deleted": true,
+		"stream":          true,
+	}
+	options, err := parseGetOptions(postData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := getOptions{Columns: []string{"ID", "NAME"}, OrderBy: []string{"NAME:desc", "ID"}, Limit: 10, Offset: 5, IncludeDeleted: true, Stream: true}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("got %+v, want %+v", options, want)
+	}
+	if !reflect.DeepEqual(postData, map[string]interface{}{"NAME:=": "Ann"}) {
+		t.Errorf("got %v left in the post data, want only the where parameter", postData)
+	}
+	if got := options.selectList(); got != "ID, NAME" {
+		t.Errorf("got select list %q", got)
+	}
+	if got := options.orderByClause(); got != " ORDER BY NAME DESC, ID" {
+		t.Errorf("got order by %q", got)
+	}
+	if got := options.columnNames(); !reflect.DeepEqual(got, []string{"ID", "NAME", "NAME", "ID"}) {
+		t.Errorf("got column names %v", got)
+	}
+}
+
+func TestParseGetOptionsInvalid(t *testing.T) {
+	tests := []struct {
+		postData map[string]interface{}
+		code     string
+	}{
+		{map[string]interface{}{"columns": 1.0}, "invalid_columns"},
+		{map[string]interface{}{"columns": []interface{}{"ID", 1.0}}, "invalid_columns"},
+		{map[string]interface{}{"order_by": "ID:up"}, "unknown_sort_direction"},
+		{map[string]interface{}{"limit": -1.0}, "invalid_limit"},
+		{map[string]interface{}{"limit": 1.5}, "invalid_limit"},
+		{map[string]interface{}{"offset": "1"}, "invalid_offset"},
+		{map[string]interface{}{"page_token": "not a token"}, "invalid_page_token"},
+		{map[string]interface{}{"offset": 5.0}, "missing_limit"},
+		{map[string]interface{}{"page_token": getOptions{Limit: 10}.nextPageToken(20)}, "missing_limit"},
+	}
+	for _, test := range tests {
+		_, err := parseGetOptions(test.postData)
+		var typed *database.Error
+		if !errors.As(err, &typed) || typed.Kind != database.KindValidation || typed.Code != test.code {
+			t.Errorf("%v: got %v, want a validation error with code %s", test.postData, err, test.code)
+		}
+	}
+}
+
+func TestPaging(t *testing.T) {
+	options := getOptions{Limit: 10, Offset: 20}
+	token := options.nextPageToken(35)
+	offset, err := decodePageToken(token)
+	if err != nil || offset != 30 {
+		t.Errorf("got offset %d %v from the next page token, want 30", offset, err)
+	}
+	if token := (getOptions{Limit: 10, Offset: 30}).nextPageToken(35); token != "" {
+		t.Errorf("got next page token %q on the last page, want none", token)
+	}
+	tests := []struct {
+		dialect database.Dialect
+		ordered bool
+		paging  string
+	}{
+		{database.Oracle{}, false, " OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY"},
+		{database.SQLServer{}, false, " ORDER BY (SELECT NULL) OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY"},
+		{database.SQLServer{}, true, " OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY"},
+		{database.Postgres{}, false, " OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY"},
+		{database.SQLite{}, false, " LIMIT 10 OFFSET 20"},
+	}
+	for _, test := range tests {
+		options := getOptions{Limit: 10, Offset: 20}
+		if test.ordered {
+			options.OrderBy = []string{"ID"}
+		}
+		if got := options.pagingClause(test.dialect); got != test.paging {
+			t.Errorf("%T ordered %v: got %q, want %q", test.dialect, test.ordered, got, test.paging)
+		}
+	}
+	if got := (getOptions{}).pagingClause(database.SQLite{}); got != "" {
+		t.Errorf("got paging %q without a limit, want none", got)
+	}
+}
+
+func TestToInt(t *testing.T) {
+	for _, value := range []interface{}{int64(7), 7.0, "7", []byte("7")} {
+		if got := toInt(value); got != 7 {
+			t.Errorf("%T: got %d, want 7", value, got)
+		}
+	}
+	defer func() {
+		err, _ := recover().(error)
+		var typed *database.Error
+		if !errors.As(err, &typed) || typed.Code != "internal_error" {
+			t.Errorf("got %v, want an internal error", err)
+		}
+	}()
+	toInt(true)
+}
@@ -1,26 +1,48 @@
 package webservices
 
 import (
+	"context"
 	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/query"
 	"github.com/hunter7654/go-api/router"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
 func init() {
-	router.AddAuth(router.Route{Method: "GET", Pattern: "/webservices/database/{schema_name}/{table_name}/{json}", HandlerFunc: Get})
-	router.AddAuth(router.Route{Method: "POST", Pattern: "/webservices/database/{schema_name}/{table_name}", HandlerFunc: Insert})
-	router.AddAuth(router.Route{Method: "PUT", Pattern: "/webservices/database/{schema_name}/{table_name}", HandlerFunc: Update})
+	for _, prefix := range []string{"/webservices", "/webservices/{datasource}"} {
+		router.AddAuth(router.Route{Method: "GET", Pattern: prefix + "/database/{schema_name}/{table_name}/{json}", HandlerFunc: router.Handle(Get)})
+		router.AddAuth(router.Route{Method: "POST", Pattern: prefix + "/database/{schema_name}/{table_name}", HandlerFunc: router.Handle(Insert)})
+		router.AddAuth(router.Route{Method: "PUT", Pattern: prefix + "/database/{schema_name}/{table_name}", HandlerFunc: router.Handle(Update)})
+		router.AddAuth(router.Route{Method: "DELETE", Pattern: prefix + "/database/{schema_name}/{table_name}", HandlerFunc: router.Handle(Delete)})
+		router.AddAuth(router.Route{Method: "POST", Pattern: prefix + "/database/{schema_name}/{table_name}/upsert", HandlerFunc: router.Handle(Upsert)})
+	}
 }
 
 /*
 Webservices Guide.
 
+Databases:
+	The webservices work against Oracle, SQL Server, Postgres and SQLite. Which one is used
+	depends on the driver of source, everything that differs between them
+	is kept in its database.Dialect. The examples below use Oracle.
+
+	On SQLite the schema is the name of an attached database, usually main. Sequences are
+	only used on Oracle, SQL Server and Postgres, and the upsert method needs a unique
+	constraint on the key columns on Postgres and SQLite.
+
+Data sources:
+	Every method runs against the default data source unless another one is named, either by
+	adding its name after webservices in the url or by passing it in the X-Data-Source header.
+	E.g. webservices/warehouse/database/schema/table uses the data source registered with
+	database.AddDataSource("warehouse", ...). The url takes priority over the header. A data
+	source can not be named database as its urls could not be told apart from the default one's.
+
 Get:
 	Takes a schema and a table name and returns all data in that table.
 	E.g. webservices/database/schema/table would return all data in the SCHEMA.TABLE table.
@@ -43,6 +65,18 @@ Post:
 	the columns that the data is to be inserted to.
 	E.g. {COL1:"Val1", COL2:"Val2", COL3:"Val3"}
 
+	To insert several rows at once post an array of these objects instead. All of the rows are
+	inserted in a single transaction, so if any of them fail none are saved, and the ids are
+	returned as an array in the same order as the posted rows. Rows with the same columns are
+	inserted together, up to 100 at a time, in a single statement. When the ids or the inserted rows
+	have to be returned, Oracle, SQL Server and SQLite insert one row per statement instead as they
+	can not return the values of a multi row insert in the order the rows were posted.
+	E.g. [{COL1:"Val1", COL2:"Val2"}, {COL1:"Val3", COL2:"Val4"}]
+	An empty array is refused, as is a column name with a comparator after it.
+
+	Adding ?return=row to the url returns the whole inserted row (or an array of rows) instead of
+	the id, including any defaults and columns set by triggers.
+
 Put:
 	This works almost the same way as the post method.
 	It takes a schema name, table name and json array of values exactly the same as the post method.
@@ -55,13 +89,20 @@ Put:
 	=       	-- Column equals value
 	>=      	-- Column equal to or greater than value
 	<=      	-- Column less than or equal to
+	>       	-- Column greater than value
+	<       	-- Column less than value
 	!=      	-- Column does not equal
 	null    	-- Column is null
 	notnull 	-- Column is not null
+	me      	-- Column equals the logged in user's username
+	like    	-- Column matches the pattern using % and _ wildcards
+	ilike   	-- The same as like but ignores case
+	between 	-- Column is between the two values, inclusive
 	in 		  	-- Column is in array
 						(To use this the passed parameter
-						needs to be a string of values
+						needs to be an array or a string of values
 						separated by a comma) E.g. "COL1:in":"Val1,Val2,Val3"
+	notin   	-- Column is not in array, passed the same way as in
 	Example json array:
 	{
 	COL1 : Val1,
@@ -72,284 +113,599 @@ Put:
 	"COL6:null" : "",
 	"COL7:notnull" : "",
 	"COL8:in" : "Val1,Val2,Val3",
+	"COL9:like" : "Val%",
+	"COL10:between" : ["01/01/2018", "31/12/2018"],
+	}
+
+	All of the where parameters must match. To match any one of several sets of parameters
+	instead pass them as a list of objects under an "or" key. Each object is matched in the
+	same way as the top level, so or groups can be nested inside each other. If more than one
+	or group is needed at the same level give the keys a suffix to keep them unique.
+	{
+	"COL1:=" : "Val1",
+	"or" : [{"COL2:=" : "Val2"}, {"COL3:ilike" : "%val%", "COL4:notnull" : ""}],
+	"or:2" : [{"COL5:<" : 10}, {"COL5:>" : 20}],
+	}
+	would match COL1 = Val1 AND (COL2 = Val2 OR (COL3 LIKE %val% AND COL4 IS NOT NULL))
+	AND (COL5 < 10 OR COL5 > 20).
+
+	The get method takes the same where parameters in its json.
+
+	Adding ?return=row to the url returns an array of the updated rows instead of a message.
+
+Delete:
+	Takes a schema name, table name and a json array containing only where parameters.
+	These use exactly the same column:comparison format as the put method.
+
+	At least one where parameter must be passed, a delete without one is refused rather
+	than emptying the table. It returns the number of rows that were deleted.
+	E.g. {"COL1:=" : "Val1"}
+
+Upsert:
+	Posting to webservices/database/schema/table/upsert inserts the row if it does not exist
+	and updates it if it does, in a single MERGE statement so that two callers can not both
+	insert the same row. It takes a json array of columns and values the same as the post
+	method, with the columns used to find the existing row followed by :key.
+	E.g. {"COL1:key" : "Val1", COL2 : "Val2", COL3 : "Val3"}
+
+	At least one key column must be passed. If the row is inserted CREATED_DATE and CREATED_BY
+	are set (along with the ID if the table has a SEQ_ sequence), if it is updated UPDATED_DATE
+	and UPDATED_BY are set instead. It returns the number of rows that were merged.
+
+Soft deletes:
+	If a table has both DELETED_DATE and DELETED_BY columns the delete method will not remove
+	any rows. Instead it stamps those columns with the current date and user on every matching
+	row that has not already been deleted.
+
+	The get method hides rows with a DELETED_DATE on these tables. To return them as well
+	pass "include_deleted" : true in the json array.
+
+Get options:
+	As well as where parameters the json array passed to the get method can contain these options:
+	columns      	-- The columns to return instead of all of them. Either an array or
+						a comma separated string. E.g. "columns" : ["COL1", "COL2"]
+	order_by     	-- The columns to sort by in the same format as columns. Each column can be
+						followed by :asc or :desc. E.g. "order_by" : "COL1:desc,COL2"
+	limit        	-- The maximum number of rows to return
+	offset       	-- The number of rows to skip before returning any
+	page_token   	-- The next_page_token from a previous response, used instead of offset
+						Both offset and page_token are refused unless a limit is passed.
+	stream       	-- When true the rows are written out as they are read from the database
+						instead of all at once. Use this for exporting large tables.
+						It is ignored when a limit is passed. If the statement fails after the
+						first rows have been sent the connection is closed without finishing the array.
+
+	When a limit is passed the response is no longer a plain array but an object containing
+	the total number of matching rows, the rows themselves and a token for the next page.
+	The token is left out on the last page. Passing an order_by is recommended when paging
+	so that the rows come back in the same order each time.
+	{
+	"total" : 120,
+	"next_page_token" : "NTA",
+	"data" : [...]
+	}
+
+Export formats:
+	The get method can also return its rows as csv (with a header row), newline delimited json
+	or an xlsx workbook. The format is chosen with a format query parameter or, if that is not
+	passed, the Accept header:
+	?format=csv     	-- text/csv
+	?format=ndjson  	-- application/x-ndjson
+	?format=xlsx    	-- application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+	?format=json    	-- application/json (the default)
+
+	Other formats are always streamed and sent as a file download named after the table.
+	Dates are written as 2006-01-02T15:04:05-07:00 so they can be posted back unchanged.
+	The limit and offset options still apply but the total and next page token are only
+	returned by the json format.
+
+Errors:
+	A request that fails is answered with RFC 7807 problem details, sent as application/problem+json.
+	The code is machine readable and the instance is the request's X-Request-ID. Every unknown
+	column is listed in invalid-params rather than only the first one, e.g.
+	{
+	"type" : "urn:go-api:problem:column_not_recognised",
+	"title" : "Bad Request",
+	"status" : 400,
+	"detail" : "2 column names not recognised",
+	"instance" : "6f1c0e4d9a2b4c8e8f3a1b2c3d4e5f60",
+	"code" : "column_not_recognised",
+	"invalid-params" : [{"name" : "COL1:=", "reason" : "column name not recognised"}, {"name" : "COL2", "reason" : "column name not recognised"}]
 	}
+	The status code depends on what went wrong:
+	401	-- no token was passed or it is not valid
+	400	-- the request is not valid, e.g. an unknown column or comparator, or no where parameters
+	403	-- the caller is not allowed to do what was asked
+	404	-- the data source, schema or table does not exist
+	409	-- a unique, primary or foreign key constraint was violated
+	503	-- the database could not be reached
+	504	-- the route's statement timeout passed before the database answered
+	500	-- anything else. The details are logged and sent to Sentry rather than returned
 
  */
-func Get(w http.ResponseWriter, r *http.Request) {
+func Get(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	source := database.RequestDataSource(r)
 	var postData map[string]interface{}
-	var params []interface{}
+	jwtData, _ := r.Context().Value(database.MyKey).(database.JwtData)
 	data := database.GetParameters(r)
 	if err := json.Unmarshal([]byte(data["json"]), &postData); err != nil {
-		panic(err)
+		return database.ValidationError("invalid_json", "the json in the url could not be read : "+err.Error())
 	}
-	CheckValidParameters(data, postData)
-	whereData := make(map[string]interface{}, 0)
-	for columnName, value := range postData {
-		if len(strings.Split(columnName, ":")) > 1 {
-			whereData[columnName] = value
-			delete(postData, columnName)
-		}
+	options, err := parseGetOptions(postData)
+	if err != nil {
+		return err
 	}
-	sql := `SELECT * FROM ` + data["schema_name"] + `.` + data["table_name"] + ` WHERE `
-	for columnName, data := range whereData {
-		data = ConvertToOracleDate(data)
-		split := strings.Split(columnName, ":")
-		switch split[1] {
-		case "=":
-			sql += split[0] + " = :v AND "
-			params = append(params, data)
-			break
-		case ">=":
-			sql += split[0] + " >= :v AND "
-			params = append(params, data)
-			break
-		case "<=":
-			sql += split[0] + " <= :v AND "
-			params = append(params, data)
-			break
-		case "!=":
-			sql += split[0] + " != :v AND "
-			params = append(params, data)
-			break
-		case "null":
-			sql += split[0] + " IS NULL AND "
-			break
-		case "notnull":
-			sql += split[0] + " IS NOT NULL AND "
-			break
-		case "in":
-			sql += split[0] + " IN("
-			for temp := range strings.Split(data.(string), ",") {
-				sql += ":v, "
-				params = append(params, temp)
-			}
-			sql = sql[0 : len(sql)-2]
-			sql += ") AND "
-			break
-		default:
-			panic(database.ErrorResponse{Error: "Unknown comparator in where clause", StackTrace: string(debug.Stack())})
-		}
-
+	softDelete, err := CheckValidParameters(ctx, source, data, postData, options.columnNames()...)
+	if err != nil {
+		return err
+	}
+	dialect := source.Dialect()
+	params := query.NewParams(source)
+	where, err := query.Where(query.SplitWhere(postData), params, jwtData.Username)
+	if err != nil {
+		return err
+	}
+	if softDelete && !options.IncludeDeleted {
+		where = strings.TrimSuffix("DELETED_DATE IS NULL AND "+where, " AND ")
+	}
+	sql := `SELECT ` + options.selectList() + ` FROM ` + data["schema_name"] + `.` + data["table_name"]
+	if where != "" {
+		sql += ` WHERE ` + where
 	}
-	sql = sql[0 : len(sql)-5]
-	fmt.Fprintln(w, database.RunGet(sql, database.DatabaseConn /*, params...*/))
+	if format := database.RequestFormat(r); format != database.FormatJSON {
+		w.Header().Set("Content-Type", database.ContentTypes[format])
+		w.Header().Set("Content-Disposition", `attachment; filename="`+data["table_name"]+`.`+format+`"`)
+		database.StreamFormatContext(ctx, w, format, sql+options.orderByClause()+options.pagingClause(dialect), source, params.Values...)
+		return nil
+	}
+	if options.Limit == 0 && options.Stream {
+		database.StreamGetContext(ctx, w, sql+options.orderByClause(), source, params.Values...)
+		return nil
+	}
+	if options.Limit == 0 {
+		fmt.Fprintln(w, database.RunGetContext(ctx, sql+options.orderByClause(), source, params.Values...))
+		return nil
+	}
+	countData := database.GetQueryAsArrayContext(ctx, `SELECT COUNT(*) TOTAL FROM (`+sql+`) t`, source, params.Values...)
+	//postgres folds the alias to lower case
+	response := pageResponse{Total: toInt(lowerKeys(countData)[0]["total"])}
+	response.Data = database.GetQueryAsArrayContext(ctx, sql+options.orderByClause()+options.pagingClause(dialect), source, params.Values...)
+	database.FormatDates(response.Data)
+	response.NextPageToken = options.nextPageToken(response.Total)
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		return database.InternalError(err)
+	}
+	fmt.Fprintln(w, string(jsonData))
+	return nil
 }
 
-func Insert(w http.ResponseWriter, r *http.Request) {
-	tx, jwtData, postData, params := database.GetPostData(r, database.DatabaseConn)
+func Insert(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	source := database.RequestDataSource(r)
+	tx, jwtData, rows, isArray, _ := database.GetPostDataArray(r, source)
 	defer tx.Rollback()
 	data := database.GetParameters(r)
-	CheckValidParameters(data, postData)
-	tableData := make([]map[string]interface{}, 0)
-	sql := `SELECT DISTINCT OBJECT_NAME FROM DBA_OBJECTS WHERE OBJECT_TYPE = 'SEQUENCE' AND OWNER = UPPER(:v)`
-	err := json.Unmarshal([]byte(database.RunGet(sql, database.DatabaseConn, data[`schema_name`])), &tableData)
+	returnRow := r.URL.Query().Get("return") == "row"
+	if len(rows) == 0 {
+		return database.ValidationError("missing_rows", "insert requires at least one row")
+	}
+	allColumns := make(map[string]interface{}, 0)
+	for _, postData := range rows {
+		for columnName, value := range postData {
+			//the column names are put in to the sql as they are so anything after a colon is refused
+			if strings.Contains(columnName, ":") {
+				return database.ValidationError("unknown_comparator", "Unknown comparator in insert : "+columnName)
+			}
+			allColumns[columnName] = value
+		}
+	}
+	if _, err := CheckValidParameters(ctx, source, data, allColumns); err != nil {
+		return err
+	}
+	nextId := nextSequenceValue(ctx, source, data)
+	insertIds := make([]int, 0, len(rows))
+	insertedRows := make([]map[string]interface{}, 0, len(rows))
+	for _, batch := range insertBatches(rows) {
+		batchIds, batchRows := insertBatch(ctx, tx, source, jwtData, data, batch, nextId, returnRow)
+		insertIds = append(insertIds, batchIds...)
+		insertedRows = append(insertedRows, batchRows...)
+	}
+	var response interface{} = insertIds[0]
+	if returnRow && isArray {
+		response = insertedRows
+	} else if returnRow {
+		response = insertedRows[0]
+	} else if isArray {
+		response = insertIds
+	}
+	jsonData, err := json.Marshal(response)
 	if err != nil {
-		panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack()), ErrorObject: err})
-	}
-	insertId := 0
-	if stringInSlice(strings.ToUpper("SEQ_"+data["table_name"]), tableData) {
-		sql = `select ` + data["schema_name"] + `.SEQ_` + data["table_name"] + `.nextval id from dual`
-		err := json.Unmarshal([]byte(database.RunGet(sql, database.DatabaseConn)), &tableData)
-		if err != nil {
-			panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack()), ErrorObject: err})
+		return database.InternalError(err)
+	}
+	fmt.Fprintln(w, string(jsonData))
+	tx.Commit()
+	return nil
+}
+
+//returns the sql expression for the next value of the table's SEQ_ sequence or an empty
+//string if it does not have one
+func nextSequenceValue(ctx context.Context, source *database.DataSource, data map[string]string) string {
+	dialect := source.Dialect()
+	sql, params := dialect.SequencesQuery(data["schema_name"])
+	if sql == "" {
+		return ""
+	}
+	sequence := "SEQ_" + data["table_name"]
+	if !stringInSlice(sequence, database.GetQueryAsArrayContext(ctx, sql, source, params...)) {
+		return ""
+	}
+	return dialect.NextSequenceValue(data["schema_name"], sequence)
+}
+
+//the most rows, and the most bound values, put in to a single insert. Sql server allows at most
+//1000 rows in a values list and 2100 values in a statement
+const (
+	insertBatchRows   = 100
+	insertBatchValues = 2000
+)
+
+//splits the posted rows in to the batches that are each inserted with a single statement. The rows
+//in a batch all have the same columns and every batch keeps the order the rows were posted in
+func insertBatches(rows []map[string]interface{}) (batches [][]map[string]interface{}) {
+	var batchColumns string
+	for _, postData := range rows {
+		columns := strings.Join(sortedColumns(postData), ",")
+		last := len(batches) - 1
+		if last < 0 || columns != batchColumns || len(batches[last]) == insertBatchRows || (len(batches[last])+1)*(len(postData)+2) > insertBatchValues {
+			batches = append(batches, nil)
+			last++
+			batchColumns = columns
 		}
-		switch tableData[0]["ID"].(type) {
-		case float64:
-			insertId = int(tableData[0]["ID"].(float64))
-			if err != nil {
-				panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack()), ErrorObject: err})
-			}
-		case string:
-			insertId, err = strconv.Atoi(tableData[0]["ID"].(string))
-			if err != nil {
-				panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack()), ErrorObject: err})
-			}
-		default:
-			panic(database.ErrorResponse{Error: "ID type not recognised", StackTrace: string(debug.Stack()), ErrorObject: err})
+		batches[last] = append(batches[last], postData)
+	}
+	return
+}
+
+//returns the column names of a posted row in a fixed order
+func sortedColumns(postData map[string]interface{}) []string {
+	columns := make([]string, 0, len(postData))
+	for columnName := range postData {
+		columns = append(columns, columnName)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+//inserts a batch of rows from insertBatches and returns their ids in the same order. When returnRow
+//is set the inserted rows are returned as well. The batch is inserted with a single statement unless
+//its ids or rows are needed and the database can not return them in order, see insertRow
+func insertBatch(ctx context.Context, tx *sql.Tx, source *database.DataSource, jwtData database.JwtData, data map[string]string, batch []map[string]interface{}, nextId string, returnRow bool) (insertIds []int, insertedRows []map[string]interface{}) {
+	dialect := source.Dialect()
+	insertIds = make([]int, len(batch))
+	if (nextId != "" || returnRow) && !dialect.ReturnsInOrder() {
+		insertedRows = make([]map[string]interface{}, len(batch))
+		for i, postData := range batch {
+			insertIds[i], insertedRows[i] = insertRow(ctx, tx, source, jwtData, data, postData, nextId, returnRow)
+		}
+		return
+	}
+	params := query.NewParams(source)
+	columns := sortedColumns(batch[0])
+	insertColumns := []string{"CREATED_DATE", "CREATED_BY"}
+	if nextId != "" {
+		insertColumns = append(insertColumns, "id")
+	}
+	insertColumns = append(insertColumns, columns...)
+	values := make([][]string, len(batch))
+	for i, postData := range batch {
+		values[i] = []string{dialect.CurrentTimestamp(), params.Add(jwtData.Username)}
+		if nextId != "" {
+			values[i] = append(values[i], nextId)
+		}
+		for _, columnName := range columns {
+			values[i] = append(values[i], params.Add(ConvertToOracleDate(postData[columnName])))
+		}
+	}
+	insert, valueList := dialect.InsertRows(tableName(data), insertColumns, values)
+	if !returnRow && nextId == "" {
+		database.RunDataChangeContext(ctx, insert+valueList, tx, params.Values...)
+		return
+	}
+	before, after, _ := dialect.Returning(returnColumns(returnRow))
+	returnedRows := database.GetTxQueryAsArrayContext(ctx, insert+before+valueList+after, tx, params.Values...)
+	if nextId != "" {
+		for i, row := range lowerKeys(returnedRows) {
+			insertIds[i] = toInt(row["id"])
 		}
+	}
+	if returnRow {
+		insertedRows = returnedRows
+	}
+	return
+}
+
+//the schema and table the webservice was called for
+func tableName(data map[string]string) string {
+	return data["schema_name"] + `.` + data["table_name"]
+}
 
+//the columns an insert returns, the whole row or just the id
+func returnColumns(returnRow bool) string {
+	if returnRow {
+		return "*"
 	}
-	sql = `INSERT INTO ` + data["schema_name"] + `.` + data["table_name"] + `(CREATED_DATE, CREATED_BY, `
-	params = append(params, jwtData.Username)
-	if insertId > 0 {
-		sql += "id, "
-		params = append(params, insertId)
+	return "id"
+}
+
+//inserts a single row for the Insert webservice and returns its id. When returnRow is set the
+//inserted row is read back so that defaults and anything set by triggers are included. Oracle
+//returns the id and the row's ROWID through out parameters, which only work for a single row
+func insertRow(ctx context.Context, tx *sql.Tx, source *database.DataSource, jwtData database.JwtData, data map[string]string, postData map[string]interface{}, nextId string, returnRow bool) (insertId int, insertedRow map[string]interface{}) {
+	dialect := source.Dialect()
+	params := query.NewParams(source)
+	sqlCommand := `INSERT INTO ` + tableName(data) + `(CREATED_DATE, CREATED_BY, `
+	values := dialect.CurrentTimestamp() + `, ` + params.Add(jwtData.Username) + `, `
+	if nextId != "" {
+		sqlCommand += "id, "
+		values += nextId + `, `
 	}
 	for columnName, data := range postData {
-		data = ConvertToOracleDate(data)
-		sql += columnName + `, `
-		params = append(params, data)
+		sqlCommand += columnName + `, `
+		values += params.Add(ConvertToOracleDate(data)) + `, `
 	}
-	sql = sql[0 : len(sql)-2]
-	sql += `) values (SYSDATE, :v, `
-	if insertId > 0 {
-		sql += `:v, `
+	sqlCommand = sqlCommand[0:len(sqlCommand)-2] + `)`
+	values = ` values (` + values[0:len(values)-2] + `)`
+	if before, after, ok := dialect.Returning(returnColumns(returnRow)); ok {
+		insertedRows := database.GetTxQueryAsArrayContext(ctx, sqlCommand+before+values+after, tx, params.Values...)
+		if nextId != "" {
+			insertId = toInt(lowerKeys(insertedRows)[0]["id"])
+		}
+		if returnRow {
+			insertedRow = insertedRows[0]
+		}
+		return
 	}
-	for range postData {
-		sql += `:v, `
+	sqlCommand += values
+	var id int64
+	var rowId string
+	var returning, into []string
+	if nextId != "" {
+		returning = append(returning, "id")
+		into = append(into, params.Add(sql.Out{Dest: &id}))
 	}
-	sql = sql[0 : len(sql)-2]
-	sql += `)`
-	database.RunDataChange(sql, tx, params...)
-	fmt.Fprintln(w, insertId)
-	tx.Commit()
+	if returnRow {
+		returning = append(returning, "ROWIDTOCHAR(ROWID)")
+		into = append(into, params.Add(sql.Out{Dest: &rowId}))
+	}
+	sqlCommand += ` RETURNING ` + strings.Join(returning, ", ") + ` INTO ` + strings.Join(into, ", ")
+	database.RunDataChangeContext(ctx, sqlCommand, tx, params.Values...)
+	insertId = int(id)
+	if returnRow {
+		insertedRow = database.GetTxRowContext(ctx, `SELECT * FROM `+tableName(data)+` WHERE ROWID = CHARTOROWID(:v)`, tx, rowId)
+	}
+	return
 }
 
-func Update(w http.ResponseWriter, r *http.Request) {
-	tx, jwtData, postData, params := database.GetPostData(r, database.DatabaseConn)
+func Update(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	source := database.RequestDataSource(r)
+	tx, jwtData, postData, _ := database.GetPostData(r, source)
 	defer tx.Rollback()
 	data := database.GetParameters(r)
-	CheckValidParameters(data, postData)
-	whereData := make(map[string]interface{}, 0)
-	for columnName, value := range postData {
-		if len(strings.Split(columnName, ":")) > 1 {
-			whereData[columnName] = value
-			delete(postData, columnName)
-		}
+	returnRow := r.URL.Query().Get("return") == "row"
+	if _, err := CheckValidParameters(ctx, source, data, postData); err != nil {
+		return err
 	}
-	sql := `UPDATE ` + data["schema_name"] + `.` + data["table_name"] + ` SET UPDATED_DATE = SYSDATE ,UPDATED_BY = :v, `
-	params = append(params, jwtData.Username)
+	whereData := query.SplitWhere(postData)
+	dialect := source.Dialect()
+	params := query.NewParams(source)
+	table := data["schema_name"] + `.` + data["table_name"]
+	sql := `UPDATE ` + table + ` SET UPDATED_DATE = ` + dialect.CurrentTimestamp() + ` ,UPDATED_BY = ` + params.Add(jwtData.Username) + `, `
 	for columnName, data := range postData {
-		data = ConvertToOracleDate(data)
-		sql += columnName + ` = :v, `
-		params = append(params, data)
+		sql += columnName + ` = ` + params.Add(ConvertToOracleDate(data)) + `, `
 	}
 	sql = sql[0 : len(sql)-2]
-	sql += ` WHERE `
-	for columnName, data := range whereData {
-		data = ConvertToOracleDate(data)
-		split := strings.Split(columnName, ":")
-		switch split[1] {
-		case "=":
-			sql += split[0] + " = :v AND "
-			params = append(params, data)
-			break
-		case ">=":
-			sql += split[0] + " >= :v AND "
-			params = append(params, data)
-			break
-		case "<=":
-			sql += split[0] + " <= :v AND "
-			params = append(params, data)
-			break
-		case "!=":
-			sql += split[0] + " != :v AND "
-			params = append(params, data)
-			break
-		case "null":
-			sql += split[0] + " IS NULL AND "
-			break
-		case "notnull":
-			sql += split[0] + " IS NOT NULL AND "
-			break
-		case "me":
-			sql += split[0] + " = :v AND "
-			params = append(params, jwtData.Username)
-			break
-		case "in":
-			sql += split[0] + " IN("
-			for temp := range strings.Split(data.(string), ",") {
-				sql += ":v, "
-				params = append(params, temp)
+	whereStart := len(params.Values)
+	where, err := query.Where(whereData, params, jwtData.Username)
+	if err != nil {
+		return err
+	}
+	if where == "" {
+		return database.ValidationError("missing_where", "update requires at least one where parameter")
+	}
+	if !returnRow {
+		database.RunDataChangeContext(ctx, sql+` WHERE `+where, tx, params.Values...)
+		fmt.Fprintln(w, "Record successfully updated")
+		tx.Commit()
+		return nil
+	}
+	var updatedRows []map[string]interface{}
+	if before, after, ok := dialect.Returning("*"); ok {
+		updatedRows = database.GetTxQueryAsArrayContext(ctx, sql+before+` WHERE `+where+after, tx, params.Values...)
+	} else {
+		//RETURNING INTO can only bind a single row outside of PL/SQL, so the matching rows are
+		//locked and their ROWIDs read first and then read back once they have been updated.
+		//Oracle placeholders are positional so the where clause can be reused with just its own values
+		rowIds := database.GetTxQueryAsArrayContext(ctx, `SELECT ROWIDTOCHAR(ROWID) RID FROM `+table+` WHERE `+where+` FOR UPDATE`, tx, params.Values[whereStart:]...)
+		database.RunDataChangeContext(ctx, sql+` WHERE `+where, tx, params.Values...)
+		updatedRows = make([]map[string]interface{}, 0, len(rowIds))
+		for start := 0; start < len(rowIds); start += 1000 {
+			rowIdParams := query.NewParams(source)
+			var placeholders []string
+			for _, rowId := range rowIds[start:minInt(start+1000, len(rowIds))] {
+				placeholders = append(placeholders, "CHARTOROWID("+rowIdParams.Add(rowId["RID"])+")")
 			}
-			sql = sql[0 : len(sql)-2]
-			sql += ") AND "
-			break
-		default:
-			panic(database.ErrorResponse{Error: "Unknown comparator in where clause", StackTrace: string(debug.Stack())})
+			updatedRows = append(updatedRows, database.GetTxQueryAsArrayContext(ctx, `SELECT * FROM `+table+` WHERE ROWID IN (`+strings.Join(placeholders, ", ")+`)`, tx, rowIdParams.Values...)...)
 		}
+	}
+	jsonData, err := json.Marshal(updatedRows)
+	if err != nil {
+		return database.InternalError(err)
+	}
+	fmt.Fprintln(w, string(jsonData))
+	tx.Commit()
+	return nil
+}
 
+func Upsert(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	source := database.RequestDataSource(r)
+	tx, jwtData, postData, _ := database.GetPostData(r, source)
+	defer tx.Rollback()
+	data := database.GetParameters(r)
+	if _, err := CheckValidParameters(ctx, source, data, postData); err != nil {
+		return err
 	}
-	sql = sql[0 : len(sql)-5]
-	database.RunDataChange(sql, tx, params...)
-	fmt.Fprintln(w, "Record successfully updated")
+	params := query.NewParams(source)
+	var keyColumns, valueColumns []string
+	values := make(map[string]interface{}, 0)
+	for columnName, value := range postData {
+		split := strings.Split(columnName, ":")
+		if len(split) > 1 && split[1] != "key" {
+			return database.ValidationError("unknown_comparator", "Unknown comparator in upsert : "+columnName)
+		}
+		if len(split) > 1 {
+			keyColumns = append(keyColumns, split[0])
+		} else {
+			valueColumns = append(valueColumns, split[0])
+		}
+		values[split[0]] = ConvertToOracleDate(value)
+	}
+	if len(keyColumns) == 0 {
+		return database.ValidationError("missing_key", "upsert requires at least one key column")
+	}
+	table := data["schema_name"] + `.` + data["table_name"]
+	sql := params.Dialect.Upsert(table, keyColumns, valueColumns, values, jwtData.Username, nextSequenceValue(ctx, source, data), params.Add)
+	res := database.RunDataChangeContext(ctx, sql, tx, params.Values...)
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return database.InternalError(err)
+	}
+	fmt.Fprintln(w, rowsAffected)
 	tx.Commit()
+	return nil
 }
 
-func CheckValidParameters(data map[string]string, postData map[string]interface{}) {
-	tableData := make([]map[string]interface{}, 0)
-	sql := `select DISTINCT username from dba_users`
-	err := json.Unmarshal([]byte(database.RunGet(sql, database.DatabaseConn)), &tableData)
+func Delete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	source := database.RequestDataSource(r)
+	tx, jwtData, postData, _ := database.GetPostData(r, source)
+	defer tx.Rollback()
+	data := database.GetParameters(r)
+	softDelete, err := CheckValidParameters(ctx, source, data, postData)
+	if err != nil {
+		return err
+	}
+	for columnName := range postData {
+		if !query.IsWhereKey(columnName) {
+			return database.ValidationError("missing_comparator", "column passed without a comparator : "+columnName)
+		}
+	}
+	params := query.NewParams(source)
+	sql := `DELETE FROM ` + data["schema_name"] + `.` + data["table_name"] + ` WHERE `
+	if softDelete {
+		sql = `UPDATE ` + data["schema_name"] + `.` + data["table_name"] + ` SET DELETED_DATE = ` + params.Dialect.CurrentTimestamp() + `, DELETED_BY = ` + params.Add(jwtData.Username) + ` WHERE DELETED_DATE IS NULL AND `
+	}
+	where, err := query.Where(postData, params, jwtData.Username)
 	if err != nil {
-		panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack()), ErrorObject: err})
+		return err
 	}
-	if !stringInSlice(strings.ToUpper(data["schema_name"]), tableData) {
-		panic(database.ErrorResponse{Error: "schema name not recognised", StackTrace: string(debug.Stack())})
+	if where == "" {
+		return database.ValidationError("missing_where", "delete requires at least one where parameter")
 	}
-	sql = `SELECT DISTINCT OBJECT_NAME FROM DBA_OBJECTS WHERE OBJECT_TYPE = 'TABLE' AND OWNER = UPPER(:v)`
-	json.Unmarshal([]byte(database.RunGet(sql, database.DatabaseConn, data[`schema_name`])), &tableData)
-	if !stringInSlice(strings.ToUpper(data["table_name"]), tableData) {
-		panic(database.ErrorResponse{Error: "table name not recognised", StackTrace: string(debug.Stack())})
+	res := database.RunDataChangeContext(ctx, sql+`(`+where+`)`, tx, params.Values...)
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return database.InternalError(err)
 	}
+	fmt.Fprintln(w, rowsAffected)
+	tx.Commit()
+	return nil
+}
+
+//checks that the schema, table, posted columns and any extra named columns exist and reports whether the table
+//carries the DELETED_DATE and DELETED_BY columns needed for soft deletes. A not found error is returned for an
+//unknown schema or table and a validation error listing every unknown column in its invalid params
+func CheckValidParameters(ctx context.Context, source *database.DataSource, data map[string]string, postData map[string]interface{}, columns ...string) (softDelete bool, err error) {
+	dialect := source.Dialect()
+	sql, params := dialect.SchemasQuery()
+	if !stringInSlice(data["schema_name"], database.GetQueryAsArrayContext(ctx, sql, source, params...)) {
+		return false, database.NotFoundError("schema_not_found", "schema name not recognised")
+	}
+	sql, params = dialect.TablesQuery(data["schema_name"])
+	if !stringInSlice(data["table_name"], database.GetQueryAsArrayContext(ctx, sql, source, params...)) {
+		return false, database.NotFoundError("table_not_found", "table name not recognised")
+	}
+	sql, params = dialect.ColumnsQuery(data["schema_name"], data["table_name"])
+	tableData := database.GetQueryAsArrayContext(ctx, sql, source, params...)
+	softDelete = stringInSlice("DELETED_DATE", tableData) && stringInSlice("DELETED_BY", tableData)
+	var invalid []database.InvalidParam
 	if postData != nil {
-		sql = `SELECT column_name FROM all_tab_cols WHERE owner = UPPER(:v) AND table_name = UPPER(:v)`
-		json.Unmarshal([]byte(database.RunGet(sql, database.DatabaseConn, data[`schema_name`], data[`table_name`])), &tableData)
 		for columnName, value := range postData {
+			if query.IsOrGroup(columnName) {
+				columns = append(columns, query.Columns(map[string]interface{}{columnName: value})...)
+				continue
+			}
 			if value == nil && len(strings.Split(columnName, ":")) < 1 {
 				delete(postData, columnName)
 			}
-			if !stringInSlice(strings.ToUpper(strings.Split(columnName, ":")[0]), tableData) {
-				panic(database.ErrorResponse{Error: "column name not recognised : " + columnName, StackTrace: string(debug.Stack())})
+			if !stringInSlice(strings.Split(columnName, ":")[0], tableData) {
+				invalid = append(invalid, database.InvalidParam{Name: columnName, Reason: "column name not recognised"})
 			}
 		}
 	}
+	for _, columnName := range columns {
+		if !stringInSlice(columnName, tableData) {
+			invalid = append(invalid, database.InvalidParam{Name: columnName, Reason: "column name not recognised"})
+		}
+	}
+	if len(invalid) == 1 {
+		return false, database.InvalidParamsError("column_not_recognised", "column name not recognised : "+invalid[0].Name, invalid)
+	}
+	if len(invalid) > 1 {
+		return false, database.InvalidParamsError("column_not_recognised", strconv.Itoa(len(invalid))+" column names not recognised", invalid)
+	}
+	return
 }
 
+//converts strings in any of the date formats the webservices accept in to dates
 func ConvertToOracleDate(data interface{}) (interface{}) {
-	if stringData, ok := data.(string); ok {
-		if stringData != "" {
-			if t, err := time.Parse("02-01-2006", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("2-1-2006", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("02/01/2006", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("2/1/2006", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("02-01-2006 15:04", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("2-1-2006 15:4", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("02/01/2006 15:04", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("2/1/2006 15:4", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("2006-01-02T15:04:05.000Z", stringData); err == nil {
-				data = t
-				return data
-			}
-			if t, err := time.Parse("2006-01-02T15:04:05-07:00", stringData); err == nil {
-				data = t
-				return data
-			}
-		}
-	}
-	return data
+	return query.ConvertDate(data)
 }
 
+//reports whether any value in the list matches a, ignoring case as databases differ in how they store names
 func stringInSlice(a string, list []map[string]interface{}) bool {
 	for _, data := range list {
 		for _, b := range data {
-			if b == a {
+			if bytes, ok := b.([]byte); ok {
+				b = string(bytes)
+			}
+			if b, ok := b.(string); ok && strings.EqualFold(a, b) {
 				return true
 			}
 		}
 	}
 	return false
 }
+
+//returns a copy of each row with its column names in lower case, as databases differ in the case they return them in
+func lowerKeys(rows []map[string]interface{}) []map[string]interface{} {
+	lowered := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		loweredRow := make(map[string]interface{}, len(row))
+		for columnName, value := range row {
+			loweredRow[strings.ToLower(columnName)] = value
+		}
+		lowered = append(lowered, loweredRow)
+	}
+	return lowered
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,359 @@
+package webservices
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/router"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//registers a new sqlite database as the default data source with a PEOPLE table and a soft deleted PETS table
+func newTestDataSource(t *testing.T) *database.DataSource {
+	t.Helper()
+	source := &database.DataSource{Driver: "sqlite3", ConnectionString: filepath.Join(t.TempDir(), "test.db")}
+	if err := database.InitDB(source); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Connection.Close() })
+	database.AddDataSource(database.DefaultDataSource, source)
+	for _, statement := range []string{
+		`CREATE TABLE PEOPLE (ID INTEGER PRIMARY KEY, NAME TEXT, AGE INTEGER, CREATED_DATE TEXT, CREATED_BY TEXT, UPDATED_DATE TEXT, UPDATED_BY TEXT)`,
+		`CREATE TABLE PETS (ID INTEGER PRIMARY KEY, NAME TEXT, CREATED_DATE TEXT, CREATED_BY TEXT, DELETED_DATE TEXT, DELETED_BY TEXT)`,
+	} {
+		if _, err := source.Connection.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return source
+}
+
+//runs a webservice as the user tester against a table in the main schema
+func serve(t *testing.T, handler router.ErrorHandlerFunc, method string, table string, filter string, body string, rawQuery string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/webservices/database/main/"+table+"?"+rawQuery, strings.NewReader(body))
+	vars := map[string]string{"schema_name": "main", "table_name": table}
+	if filter != "" {
+		vars["json"] = url.QueryEscape(filter)
+	}
+	req = mux.SetURLVars(req, vars)
+	req = req.WithContext(context.WithValue(req.Context(), database.MyKey, database.JwtData{Username: "tester"}))
+	res := httptest.NewRecorder()
+	router.HandleError(router.Handle(handler))(res, req)
+	return res
+}
+
+func decode(t *testing.T, res *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.Code, res.Body.String())
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), v); err != nil {
+		t.Fatalf("%v: %s", err, res.Body.String())
+	}
+}
+
+func names(rows []map[string]interface{}) (names []string) {
+	for _, row := range rows {
+		names = append(names, row["NAME"].(string))
+	}
+	return
+}
+
+func addPeople(t *testing.T, source *database.DataSource, people ...string) {
+	t.Helper()
+	for i, name := range people {
+		if _, err := source.Connection.Exec(`INSERT INTO PEOPLE (NAME, AGE) VALUES (?, ?)`, name, (i+1)*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	source := newTestDataSource(t)
+	var inserted map[string]interface{}
+	decode(t, serve(t, Insert, "POST", "PEOPLE", "", `{"NAME" : "Ann", "AGE" : 30}`, "return=row"), &inserted)
+	if inserted["NAME"] != "Ann" || inserted["CREATED_BY"] != "tester" || inserted["CREATED_DATE"] == nil {
+		t.Errorf("got row %v", inserted)
+	}
+
+	//the rows with different columns are inserted in separate batches but come back in the posted order
+	var rows []map[string]interface{}
+	decode(t, serve(t, Insert, "POST", "PEOPLE", "", `[{"NAME" : "Bob", "AGE" : 40}, {"NAME" : "Cat"}, {"NAME" : "Dan", "AGE" : 50}]`, "return=row"), &rows)
+	if got := strings.Join(names(rows), ","); got != "Bob,Cat,Dan" {
+		t.Errorf("got rows %s, want Bob,Cat,Dan", got)
+	}
+	if rows[1]["AGE"] != nil {
+		t.Errorf("got age %v for Cat, want null", rows[1]["AGE"])
+	}
+
+	if res := serve(t, Insert, "POST", "PEOPLE", "", `[{"NAME" : "Eve"}, {"NAME" : "Fay"}]`, ""); res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.Code, res.Body.String())
+	}
+	if count := len(database.GetQueryAsArray(`SELECT * FROM PEOPLE`, source)); count != 6 {
+		t.Errorf("got %d rows, want 6", count)
+	}
+
+	//nothing is saved when any of the rows fails
+	res := serve(t, Insert, "POST", "PEOPLE", "", `[{"NAME" : "Gus"}, {"ID" : 1, "NAME" : "Hal"}]`, "")
+	if res.Code != http.StatusConflict {
+		t.Errorf("got status %d for a duplicate id, want 409: %s", res.Code, res.Body.String())
+	}
+	if count := len(database.GetQueryAsArray(`SELECT * FROM PEOPLE`, source)); count != 6 {
+		t.Errorf("got %d rows after a failed insert, want 6", count)
+	}
+}
+
+func TestInvalidPostData(t *testing.T) {
+	source := newTestDataSource(t)
+	tests := []struct {
+		name    string
+		handler router.ErrorHandlerFunc
+		body    string
+		code    string
+	}{
+		{"insert", Insert, `{"NAME" : `, "invalid_json"},
+		{"insert", Insert, `[{"NAME" : "Ann"}, 1]`, "invalid_json"},
+		{"insert", Insert, `"Ann"`, "invalid_json"},
+		{"insert", Insert, `[]`, "missing_rows"},
+		{"insert", Insert, `{"NAME:=" : "z"}`, "unknown_comparator"},
+		{"insert", Insert, `[{"NAME" : "Ann"}, {"NAME) VALUES (1); --:" : "z"}]`, "unknown_comparator"},
+		{"update", Update, `{"NAME" : `, "invalid_json"},
+		{"update", Update, `[{"NAME" : "Ann"}, 1]`, "invalid_json"},
+		{"update", Update, `"Ann"`, "invalid_json"},
+	}
+	for _, test := range tests {
+		res := serve(t, test.handler, "POST", "PEOPLE", "", test.body, "")
+		if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), `"`+test.code+`"`) {
+			t.Errorf("%s %s: got status %d, want 400 %s: %s", test.name, test.body, res.Code, test.code, res.Body.String())
+		}
+	}
+	if count := len(database.GetQueryAsArray(`SELECT * FROM PEOPLE`, source)); count != 0 {
+		t.Errorf("got %d rows, want none", count)
+	}
+}
+
+func TestInsertBatches(t *testing.T) {
+	var rows []map[string]interface{}
+	for i := 0; i < insertBatchRows+10; i++ {
+		rows = append(rows, map[string]interface{}{"NAME": i})
+	}
+	rows = append(rows, map[string]interface{}{"NAME": "x", "AGE": 1}, map[string]interface{}{"AGE": 2, "NAME": "y"})
+	batches := insertBatches(rows)
+	if len(batches) != 3 || len(batches[0]) != insertBatchRows || len(batches[1]) != 10 || len(batches[2]) != 2 {
+		t.Errorf("got %d batches", len(batches))
+	}
+}
+
+func TestGet(t *testing.T) {
+	source := newTestDataSource(t)
+	addPeople(t, source, "Ann", "Bob", "Cat", "Dan", "Eve")
+
+	var rows []map[string]interface{}
+	decode(t, serve(t, Get, "GET", "PEOPLE", `{"AGE:>=" : 20, "or" : [{"NAME:=" : "Bob"}, {"NAME:like" : "%e"}], "order_by" : "NAME:desc"}`, "", ""), &rows)
+	if got := strings.Join(names(rows), ","); got != "Eve,Bob" {
+		t.Errorf("got %s, want Eve,Bob", got)
+	}
+
+	rows = nil
+	decode(t, serve(t, Get, "GET", "PEOPLE", `{"columns" : ["NAME"], "order_by" : "AGE"}`, "", ""), &rows)
+	if len(rows) != 5 || len(rows[0]) != 1 || rows[0]["NAME"] != "Ann" {
+		t.Errorf("got %v", rows)
+	}
+
+	var page pageResponse
+	decode(t, serve(t, Get, "GET", "PEOPLE", `{"limit" : 2, "order_by" : "NAME"}`, "", ""), &page)
+	if page.Total != 5 || strings.Join(names(page.Data), ",") != "Ann,Bob" || page.NextPageToken == "" {
+		t.Fatalf("got page %+v", page)
+	}
+	for page.NextPageToken != "" {
+		token := page.NextPageToken
+		page = pageResponse{}
+		decode(t, serve(t, Get, "GET", "PEOPLE", `{"limit" : 2, "order_by" : "NAME", "page_token" : "`+token+`"}`, "", ""), &page)
+	}
+	if strings.Join(names(page.Data), ",") != "Eve" {
+		t.Errorf("got last page %+v", page)
+	}
+
+	res := serve(t, Get, "GET", "PEOPLE", `{"NAME:=" : "Ann"}`, "", "format=csv")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "text/csv" || !strings.Contains(res.Body.String(), "Ann") {
+		t.Errorf("got csv %d %q", res.Code, res.Body.String())
+	}
+}
+
+//every way of getting json writes dates in the same layout, which can be posted back
+func TestGetDates(t *testing.T) {
+	source := newTestDataSource(t)
+	date := time.Date(2018, 12, 31, 10, 30, 0, 0, time.UTC)
+	for _, statement := range []string{`CREATE TABLE EVENTS (ID INTEGER PRIMARY KEY, HAPPENED DATETIME)`, `INSERT INTO EVENTS (HAPPENED) VALUES (?)`} {
+		if _, err := source.Connection.Exec(statement, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rows []map[string]interface{}
+	decode(t, serve(t, Get, "GET", "EVENTS", `{}`, "", ""), &rows)
+	var streamed []map[string]interface{}
+	decode(t, serve(t, Get, "GET", "EVENTS", `{"stream" : true}`, "", ""), &streamed)
+	var page pageResponse
+	decode(t, serve(t, Get, "GET", "EVENTS", `{"limit" : 1}`, "", ""), &page)
+	var line map[string]interface{}
+	decode(t, serve(t, Get, "GET", "EVENTS", `{}`, "", "format=ndjson"), &line)
+	for name, row := range map[string]map[string]interface{}{"json": rows[0], "stream": streamed[0], "page": page.Data[0], "ndjson": line} {
+		if row["HAPPENED"] != "2018-12-31T10:30:00+00:00" {
+			t.Errorf("%s: got date %v", name, row["HAPPENED"])
+		}
+		if got, ok := ConvertToOracleDate(row["HAPPENED"]).(time.Time); !ok || !got.Equal(date) {
+			t.Errorf("%s: got %v back from the exported date, want %v", name, ConvertToOracleDate(row["HAPPENED"]), date)
+		}
+	}
+}
+
+func TestGetInvalid(t *testing.T) {
+	newTestDataSource(t)
+	tests := []struct {
+		table  string
+		filter string
+		status int
+		code   string
+	}{
+		{"MISSING", `{}`, http.StatusNotFound, "table_not_found"},
+		{"PEOPLE", `{"NOPE:=" : 1, "ALSO:=" : 2}`, http.StatusBadRequest, "column_not_recognised"},
+		{"PEOPLE", `{"NAME:~" : 1}`, http.StatusBadRequest, "unknown_comparator"},
+		{"PEOPLE", `{"limit" : -1}`, http.StatusBadRequest, "invalid_limit"},
+		{"PEOPLE", `not json`, http.StatusBadRequest, "invalid_json"},
+	}
+	for _, test := range tests {
+		res := serve(t, Get, "GET", test.table, test.filter, "", "")
+		var problem map[string]interface{}
+		json.Unmarshal(res.Body.Bytes(), &problem)
+		if res.Code != test.status || problem["code"] != test.code {
+			t.Errorf("%s %s: got %d %s, want %d %s", test.table, test.filter, res.Code, problem["code"], test.status, test.code)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	source := newTestDataSource(t)
+	addPeople(t, source, "Ann", "Bob", "Cat")
+
+	var rows []map[string]interface{}
+	decode(t, serve(t, Update, "PUT", "PEOPLE", "", `{"AGE" : 99, "NAME:in" : "Ann,Cat"}`, "return=row"), &rows)
+	if len(rows) != 2 || rows[0]["AGE"] != 99.0 || rows[0]["UPDATED_BY"] != "tester" {
+		t.Errorf("got %v", rows)
+	}
+	if count := len(database.GetQueryAsArray(`SELECT * FROM PEOPLE WHERE AGE = 99`, source)); count != 2 {
+		t.Errorf("got %d updated rows, want 2", count)
+	}
+
+	if res := serve(t, Update, "PUT", "PEOPLE", "", `{"AGE" : 1}`, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for an update without a where, want 400", res.Code)
+	}
+	if count := len(database.GetQueryAsArray(`SELECT * FROM PEOPLE WHERE AGE = 1`, source)); count != 0 {
+		t.Errorf("got %d rows updated without a where, want 0", count)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	source := newTestDataSource(t)
+	person := func() map[string]interface{} {
+		t.Helper()
+		rows := database.GetQueryAsArray(`SELECT * FROM PEOPLE WHERE ID = 1`, source)
+		if len(rows) != 1 {
+			t.Fatalf("got %d rows, want 1", len(rows))
+		}
+		return rows[0]
+	}
+
+	//the insert branch only stamps the created columns
+	if res := serve(t, Upsert, "POST", "PEOPLE", "", `{"ID:key" : 1, "NAME" : "Ann", "AGE" : 30}`, ""); res.Code != http.StatusOK || strings.TrimSpace(res.Body.String()) != "1" {
+		t.Fatalf("got status %d: %s", res.Code, res.Body.String())
+	}
+	inserted := person()
+	if inserted["NAME"] != "Ann" || inserted["CREATED_BY"] != "tester" || inserted["CREATED_DATE"] == nil || inserted["UPDATED_BY"] != nil || inserted["UPDATED_DATE"] != nil {
+		t.Errorf("got inserted row %v", inserted)
+	}
+
+	//the update branch stamps the updated columns and leaves the created ones alone
+	if res := serve(t, Upsert, "POST", "PEOPLE", "", `{"ID:key" : 1, "NAME" : "Anne"}`, ""); res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.Code, res.Body.String())
+	}
+	updated := person()
+	if updated["NAME"] != "Anne" || updated["AGE"] != int64(30) || updated["UPDATED_BY"] != "tester" || updated["UPDATED_DATE"] == nil {
+		t.Errorf("got updated row %v", updated)
+	}
+	if updated["CREATED_BY"] != inserted["CREATED_BY"] || updated["CREATED_DATE"] != inserted["CREATED_DATE"] {
+		t.Errorf("got created columns %v %v changed by the update, want %v %v", updated["CREATED_BY"], updated["CREATED_DATE"], inserted["CREATED_BY"], inserted["CREATED_DATE"])
+	}
+	if count := len(database.GetQueryAsArray(`SELECT * FROM PEOPLE`, source)); count != 1 {
+		t.Errorf("got %d rows, want 1", count)
+	}
+}
+
+func TestUpsertInvalid(t *testing.T) {
+	newTestDataSource(t)
+	tests := []struct {
+		body string
+		code string
+	}{
+		{`{"NAME" : "Ann"}`, "missing_key"},
+		{`{"ID:=" : 1, "NAME" : "Ann"}`, "unknown_comparator"},
+		{`{"ID:key" : 1, "NAME:in" : "Ann"}`, "unknown_comparator"},
+	}
+	for _, test := range tests {
+		res := serve(t, Upsert, "POST", "PEOPLE", "", test.body, "")
+		if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), `"`+test.code+`"`) {
+			t.Errorf("%s: got status %d, want 400 %s: %s", test.body, res.Code, test.code, res.Body.String())
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	source := newTestDataSource(t)
+	addPeople(t, source, "Ann", "Bob", "Cat")
+
+	res := serve(t, Delete, "DELETE", "PEOPLE", "", `{"NAME:!=" : "Bob"}`, "")
+	if res.Code != http.StatusOK || strings.TrimSpace(res.Body.String()) != "2" {
+		t.Errorf("got %d %q, want 2 rows deleted", res.Code, res.Body.String())
+	}
+	if rows := database.GetQueryAsArray(`SELECT * FROM PEOPLE`, source); strings.Join(names(rows), ",") != "Bob" {
+		t.Errorf("got %v left", rows)
+	}
+	if res := serve(t, Delete, "DELETE", "PEOPLE", "", `{"NAME" : "Bob"}`, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a column without a comparator, want 400", res.Code)
+	}
+	if res := serve(t, Delete, "DELETE", "PEOPLE", "", `{}`, ""); res.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a delete without a where, want 400", res.Code)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	source := newTestDataSource(t)
+	if _, err := source.Connection.Exec(`INSERT INTO PETS (NAME) VALUES ('Rex'), ('Tom')`); err != nil {
+		t.Fatal(err)
+	}
+	if res := serve(t, Delete, "DELETE", "PETS", "", `{"NAME:=" : "Rex"}`, ""); res.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", res.Code, res.Body.String())
+	}
+	rows := database.GetQueryAsArray(`SELECT * FROM PETS WHERE NAME = 'Rex'`, source)
+	if len(rows) != 1 || rows[0]["DELETED_BY"] != "tester" {
+		t.Errorf("got %v, want Rex kept and marked deleted", rows)
+	}
+
+	var pets []map[string]interface{}
+	decode(t, serve(t, Get, "GET", "PETS", `{}`, "", ""), &pets)
+	if strings.Join(names(pets), ",") != "Tom" {
+		t.Errorf("got %v, want only Tom", pets)
+	}
+	pets = nil
+	decode(t, serve(t, Get, "GET", "PETS", `{"include_deleted" : true, "order_by" : "NAME"}`, "", ""), &pets)
+	if strings.Join(names(pets), ",") != "Rex,Tom" {
+		t.Errorf("got %v, want Rex and Tom", pets)
+	}
+}
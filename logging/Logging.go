@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+//the header a request id is taken from and echoed back in
+const RequestIDHeader = "X-Request-ID"
+
+//the level lines have to be at to be written, changed with SetLevel
+var level = new(slog.LevelVar)
+
+//writes json lines to stdout. Request handlers should use FromContext so their lines carry the request id
+var Logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+
+func init() {
+	slog.SetDefault(Logger)
+}
+
+//sets the lowest level that is written, either debug, info, warn or error
+func SetLevel(name string) error {
+	var newLevel slog.Level
+	if err := newLevel.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return errors.New("log level not recognised : " + name)
+	}
+	level.Set(newLevel)
+	return nil
+}
+
+type contextKey int
+
+const loggerKey contextKey = 0
+
+//holds the logger of a request so that attributes added further down the middleware chain,
+//like the username, are also on the lines written by the middleware above them
+type requestLogger struct {
+	lock   sync.RWMutex
+	logger *slog.Logger
+}
+
+//returns a context carrying a logger that adds args to every line
+func NewContext(ctx context.Context, args ...interface{}) context.Context {
+	return context.WithValue(ctx, loggerKey, &requestLogger{logger: Logger.With(args...)})
+}
+
+//adds args to every line written by the context's logger from now on
+func AddAttributes(ctx context.Context, args ...interface{}) {
+	if entry, ok := ctx.Value(loggerKey).(*requestLogger); ok {
+		entry.lock.Lock()
+		defer entry.lock.Unlock()
+		entry.logger = entry.logger.With(args...)
+	}
+}
+
+//returns the logger of the request the context belongs to, or Logger if it does not belong to one
+func FromContext(ctx context.Context) *slog.Logger {
+	if entry, ok := ctx.Value(loggerKey).(*requestLogger); ok {
+		entry.lock.RLock()
+		defer entry.lock.RUnlock()
+		return entry.logger
+	}
+	return Logger
+}
+
+//returns a random id for a request that was not passed one
+func NewRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
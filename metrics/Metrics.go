@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+//the prefix of every metric name
+const Namespace = "goapi"
+
+//counts every request by method, route pattern and status code
+var Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "http_requests_total",
+	Help:      "The number of requests answered, by method, route pattern and status code.",
+}, []string{"method", "route", "status"})
+
+//how long requests take by method and route pattern
+var RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: Namespace,
+	Name:      "http_request_duration_seconds",
+	Help:      "How long requests take to answer, by method and route pattern.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"method", "route"})
+
+//how long database statements take by operation, either query, exec or stream
+var QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: Namespace,
+	Name:      "db_query_duration_seconds",
+	Help:      "How long database statements take, by operation.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"operation"})
+
+//counts the database statements that failed by operation
+var QueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "db_query_errors_total",
+	Help:      "The number of database statements that failed, by operation.",
+}, []string{"operation"})
+
+//counts every time an automatic job runs
+var JobRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "job_runs_total",
+	Help:      "The number of times each automatic job has run.",
+}, []string{"job"})
+
+//counts every time an automatic job fails
+var JobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: Namespace,
+	Name:      "job_failures_total",
+	Help:      "The number of times each automatic job has failed.",
+}, []string{"job"})
+
+func init() {
+	prometheus.MustRegister(Requests, RequestDuration, QueryDuration, QueryErrors, JobRuns, JobFailures)
+}
+
+//records a database statement that took elapsed and whether it failed
+func ObserveQuery(operation string, elapsed time.Duration, failed bool) {
+	QueryDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+	if failed {
+		QueryErrors.WithLabelValues(operation).Inc()
+	}
+}
@@ -0,0 +1,53 @@
+package query
+
+import (
+	"github.com/hunter7654/go-api/database"
+	"time"
+)
+
+//Params collects the values bound to a statement while it is being built and hands out a
+//placeholder for each one in the style of the database's dialect
+type Params struct {
+	Dialect database.Dialect
+	Values  []interface{}
+}
+
+//returns an empty set of parameters for statements run against the passed data source
+func NewParams(source *database.DataSource) *Params {
+	return &Params{Dialect: source.Dialect()}
+}
+
+//binds a value to the statement and returns the placeholder to put in the sql for it
+func (params *Params) Add(value interface{}) string {
+	params.Values = append(params.Values, value)
+	return params.Dialect.Placeholder(len(params.Values))
+}
+
+//the layouts dates can be passed in, tried in this order
+var dateLayouts = []string{
+	"02-01-2006",
+	"2-1-2006",
+	"02/01/2006",
+	"2/1/2006",
+	"02-01-2006 15:04",
+	"2-1-2006 15:4",
+	"02/01/2006 15:04",
+	"2/1/2006 15:4",
+	"2006-01-02T15:04:05.000Z",
+	"2006-01-02T15:04:05-07:00",
+}
+
+//converts strings in any of the accepted date formats in to dates so they are bound as dates
+//rather than text. Anything else is returned unchanged
+func ConvertDate(data interface{}) interface{} {
+	stringData, ok := data.(string)
+	if !ok || stringData == "" {
+		return data
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, stringData); err == nil {
+			return t
+		}
+	}
+	return data
+}
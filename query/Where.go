@@ -0,0 +1,157 @@
+package query
+
+import (
+	"github.com/hunter7654/go-api/database"
+	"sort"
+	"strings"
+)
+
+/*
+Filters are json objects where each key is a column name followed by a colon and a comparator,
+e.g. {"COL1:=" : "Val1", "COL2:in" : "Val2,Val3"}. Keys named "or" (or "or:" followed by anything
+so that they are unique) hold a list of filters, any one of which has to match.
+The comparators are listed in the webservices guide.
+*/
+
+//reports whether a json key is part of a filter rather than a column value
+func IsWhereKey(key string) bool {
+	return IsOrGroup(key) || len(strings.Split(key, ":")) > 1
+}
+
+//reports whether a json key holds an or group
+func IsOrGroup(key string) bool {
+	return strings.ToLower(strings.Split(key, ":")[0]) == "or"
+}
+
+//takes the filter keys out of the posted json and returns them
+func SplitWhere(postData map[string]interface{}) map[string]interface{} {
+	filter := make(map[string]interface{}, 0)
+	for key, value := range postData {
+		if IsWhereKey(key) {
+			filter[key] = value
+			delete(postData, key)
+		}
+	}
+	return filter
+}
+
+//returns the name of every column used in a filter, including inside or groups, so that they
+//can be checked before being put in to any sql
+func Columns(filter map[string]interface{}) (columns []string) {
+	for key, value := range filter {
+		if !IsOrGroup(key) {
+			columns = append(columns, strings.Split(key, ":")[0])
+			continue
+		}
+		groups, _ := value.([]interface{})
+		for _, group := range groups {
+			groupFilter, _ := group.(map[string]interface{})
+			columns = append(columns, Columns(groupFilter)...)
+		}
+	}
+	return
+}
+
+//builds a parameterised where clause from a filter, adding its values to params. The conditions
+//are joined with AND and an empty string is returned when there are none. username is the value
+//used by the me comparator. The column names are put in to the sql as they are, so they must
+//be checked before calling this. A validation error is returned if the filter can not be understood
+func Where(filter map[string]interface{}, params *Params, username interface{}) (string, error) {
+	//the keys are sorted so the same filter always builds the same sql
+	keys := make([]string, 0, len(filter))
+	for key := range filter {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var conditions []string
+	for _, key := range keys {
+		condition, err := condition(key, filter[key], params, username)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+	return strings.Join(conditions, " AND "), nil
+}
+
+func condition(key string, data interface{}, params *Params, username interface{}) (string, error) {
+	if IsOrGroup(key) {
+		groups, ok := data.([]interface{})
+		if !ok || len(groups) == 0 {
+			return "", database.ValidationError("invalid_or_group", "or groups must be a list of objects : "+key)
+		}
+		var ors []string
+		for _, group := range groups {
+			groupFilter, ok := group.(map[string]interface{})
+			if !ok || len(groupFilter) == 0 {
+				return "", database.ValidationError("invalid_or_group", "or groups must be a list of objects : "+key)
+			}
+			where, err := Where(groupFilter, params, username)
+			if err != nil {
+				return "", err
+			}
+			ors = append(ors, "("+where+")")
+		}
+		return "(" + strings.Join(ors, " OR ") + ")", nil
+	}
+	split := strings.Split(key, ":")
+	if len(split) < 2 {
+		return "", database.ValidationError("missing_comparator", "column passed without a comparator : "+key)
+	}
+	column := split[0]
+	switch split[1] {
+	case "=", "!=", ">=", "<=", "<", ">":
+		return column + " " + split[1] + " " + params.Add(ConvertDate(data)), nil
+	case "like":
+		return column + " LIKE " + params.Add(data), nil
+	case "ilike":
+		return "UPPER(" + column + ") LIKE UPPER(" + params.Add(data) + ")", nil
+	case "null":
+		return column + " IS NULL", nil
+	case "notnull":
+		return column + " IS NOT NULL", nil
+	case "me":
+		return column + " = " + params.Add(username), nil
+	case "between":
+		values, err := listValues(data, key)
+		if err != nil {
+			return "", err
+		}
+		if len(values) != 2 {
+			return "", database.ValidationError("invalid_between", "between needs exactly two values : "+key)
+		}
+		return column + " BETWEEN " + params.Add(ConvertDate(values[0])) + " AND " + params.Add(ConvertDate(values[1])), nil
+	case "in", "notin":
+		values, err := listValues(data, key)
+		if err != nil {
+			return "", err
+		}
+		if len(values) == 0 {
+			return "", database.ValidationError("invalid_in", split[1]+" needs at least one value : "+key)
+		}
+		var placeholders []string
+		for _, value := range values {
+			placeholders = append(placeholders, params.Add(value))
+		}
+		if split[1] == "notin" {
+			return column + " NOT IN(" + strings.Join(placeholders, ", ") + ")", nil
+		}
+		return column + " IN(" + strings.Join(placeholders, ", ") + ")", nil
+	}
+	return "", database.ValidationError("unknown_comparator", "Unknown comparator in where clause : "+key)
+}
+
+//the values for in, notin and between can be passed as a json array or a comma separated string
+func listValues(data interface{}, key string) ([]interface{}, error) {
+	switch data := data.(type) {
+	case []interface{}:
+		return data, nil
+	case string:
+		var values []interface{}
+		for _, value := range strings.Split(data, ",") {
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, database.ValidationError("invalid_list", "expected a list or a comma separated string : "+key)
+}
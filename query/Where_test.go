@@ -0,0 +1,155 @@
+package query
+
+import (
+	"errors"
+	"github.com/hunter7654/go-api/database"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWhereComparators(t *testing.T) {
+	date := time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		key    string
+		value  interface{}
+		sql    string
+		values []interface{}
+	}{
+		{"COL:=", "a", "COL = $1", []interface{}{"a"}},
+		{"COL:!=", "a", "COL != $1", []interface{}{"a"}},
+		{"COL:>=", 1.0, "COL >= $1", []interface{}{1.0}},
+		{"COL:<=", 1.0, "COL <= $1", []interface{}{1.0}},
+		{"COL:>", 1.0, "COL > $1", []interface{}{1.0}},
+		{"COL:<", 1.0, "COL < $1", []interface{}{1.0}},
+		{"COL:=", "31/12/2018", "COL = $1", []interface{}{date}},
+		{"COL:like", "a%", "COL LIKE $1", []interface{}{"a%"}},
+		{"COL:ilike", "a%", "UPPER(COL) LIKE UPPER($1)", []interface{}{"a%"}},
+		{"COL:null", "", "COL IS NULL", nil},
+		{"COL:notnull", "", "COL IS NOT NULL", nil},
+		{"COL:me", "", "COL = $1", []interface{}{"user"}},
+		{"COL:between", []interface{}{"01/01/2018", "31/12/2018"}, "COL BETWEEN $1 AND $2", []interface{}{time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC), date}},
+		{"COL:between", "1,2", "COL BETWEEN $1 AND $2", []interface{}{"1", "2"}},
+		{"COL:in", "a,b,c", "COL IN($1, $2, $3)", []interface{}{"a", "b", "c"}},
+		{"COL:in", []interface{}{"a", 1.0}, "COL IN($1, $2)", []interface{}{"a", 1.0}},
+		{"COL:notin", "a,b", "COL NOT IN($1, $2)", []interface{}{"a", "b"}},
+	}
+	for _, test := range tests {
+		params := &Params{Dialect: database.Postgres{}}
+		sql, err := Where(map[string]interface{}{test.key: test.value}, params, "user")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.key, err)
+			continue
+		}
+		if sql != test.sql {
+			t.Errorf("%s: got sql %q, want %q", test.key, sql, test.sql)
+		}
+		if !reflect.DeepEqual(params.Values, test.values) {
+			t.Errorf("%s: got values %v, want %v", test.key, params.Values, test.values)
+		}
+	}
+}
+
+func TestWhereInvalid(t *testing.T) {
+	tests := []struct {
+		key   string
+		value interface{}
+		code  string
+	}{
+		{"COL", "a", "missing_comparator"},
+		{"COL:~", "a", "unknown_comparator"},
+		{"COL:between", "1", "invalid_between"},
+		{"COL:between", []interface{}{1.0, 2.0, 3.0}, "invalid_between"},
+		{"COL:in", []interface{}{}, "invalid_in"},
+		{"COL:in", 1.0, "invalid_list"},
+		{"or", "a", "invalid_or_group"},
+		{"or", []interface{}{}, "invalid_or_group"},
+		{"or", []interface{}{map[string]interface{}{}}, "invalid_or_group"},
+		{"or", []interface{}{map[string]interface{}{"COL": "a"}}, "missing_comparator"},
+	}
+	for _, test := range tests {
+		_, err := Where(map[string]interface{}{test.key: test.value}, &Params{Dialect: database.Postgres{}}, "user")
+		var typed *database.Error
+		if !errors.As(err, &typed) || typed.Kind != database.KindValidation || typed.Code != test.code {
+			t.Errorf("%s %v: got %v, want a validation error with code %s", test.key, test.value, err, test.code)
+		}
+	}
+}
+
+func TestWhereOrGroups(t *testing.T) {
+	filter := map[string]interface{}{
+		"A:=": "a",
+		"or": []interface{}{
+			map[string]interface{}{"B:=": "b"},
+			map[string]interface{}{"C:in": "c,d", "D:notnull": ""},
+		},
+		"or:2": []interface{}{
+			map[string]interface{}{"or": []interface{}{
+				map[string]interface{}{"E:=": "e"},
+				map[string]interface{}{"F:=": "f"},
+			}},
+		},
+	}
+	params := &Params{Dialect: database.Postgres{}}
+	sql, err := Where(filter, params, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A = $1 AND ((B = $2) OR (C IN($3, $4) AND D IS NOT NULL)) AND ((((E = $5) OR (F = $6))))"
+	if sql != want {
+		t.Errorf("got sql %q, want %q", sql, want)
+	}
+	if values := []interface{}{"a", "b", "c", "d", "e", "f"}; !reflect.DeepEqual(params.Values, values) {
+		t.Errorf("got values %v, want %v", params.Values, values)
+	}
+	if columns := Columns(filter); len(columns) != 6 {
+		t.Errorf("got columns %v, want 6", columns)
+	}
+}
+
+//the numbering carries on from any values added to params before the where clause
+func TestWherePlaceholders(t *testing.T) {
+	filter := map[string]interface{}{"A:=": "a", "B:between": "1,2", "C:in": "x,y"}
+	tests := []struct {
+		dialect database.Dialect
+		sql     string
+	}{
+		{database.Oracle{}, "A = :v AND B BETWEEN :v AND :v AND C IN(:v, :v)"},
+		{database.SQLServer{}, "A = @p2 AND B BETWEEN @p3 AND @p4 AND C IN(@p5, @p6)"},
+		{database.Postgres{}, "A = $2 AND B BETWEEN $3 AND $4 AND C IN($5, $6)"},
+		{database.SQLite{}, "A = ? AND B BETWEEN ? AND ? AND C IN(?, ?)"},
+	}
+	for _, test := range tests {
+		params := &Params{Dialect: test.dialect}
+		params.Add("before")
+		sql, err := Where(filter, params, "user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sql != test.sql {
+			t.Errorf("%T: got sql %q, want %q", test.dialect, sql, test.sql)
+		}
+		if values := []interface{}{"before", "a", "1", "2", "x", "y"}; !reflect.DeepEqual(params.Values, values) {
+			t.Errorf("%T: got values %v, want %v", test.dialect, params.Values, values)
+		}
+	}
+}
+
+func TestConvertDate(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{"31-12-2018", time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)},
+		{"1/2/2018 9:5", time.Date(2018, 2, 1, 9, 5, 0, 0, time.UTC)},
+		{"2018-12-31T10:30:00.000Z", time.Date(2018, 12, 31, 10, 30, 0, 0, time.UTC)},
+		{"not a date", "not a date"},
+		{"", ""},
+		{1.0, 1.0},
+	}
+	for _, test := range tests {
+		if got := ConvertDate(test.value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package router
+
+import (
+	"encoding/json"
+	"github.com/getsentry/raven-go"
+	"github.com/hunter7654/go-api/database"
+	"github.com/hunter7654/go-api/logging"
+	"net/http"
+)
+
+//a handler that returns its error rather than panicking. Wrap it with Handle to use it in a Route
+type ErrorHandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+//the content type of the problem details requests that fail are answered with
+const ProblemContentType = "application/problem+json"
+
+//the start of the type of every problem, which is followed by the error's code
+const ProblemTypePrefix = "urn:go-api:problem:"
+
+//the RFC 7807 problem details requests that fail are answered with. Code is an extension member
+//holding the same code as the end of Type so callers do not have to parse it
+type problem struct {
+	Type          string                  `json:"type"`
+	Title         string                  `json:"title"`
+	Status        int                     `json:"status"`
+	Detail        string                  `json:"detail,omitempty"`
+	Instance      string                  `json:"instance,omitempty"`
+	Code          string                  `json:"code"`
+	InvalidParams []database.InvalidParam `json:"invalid-params,omitempty"`
+}
+
+//turns a handler that returns its error in to one that can be used in a Route
+func Handle(handler ErrorHandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if err := handler(res, req); err != nil {
+			WriteError(res, req, err)
+		}
+	})
+}
+
+//answers the request with the problem details of the error. The instance is the request id. Errors that are not a *database.Error are
+//answered as internal errors. Stack traces are never sent to the caller, server errors are logged and sent
+//to Sentry with theirs. If the response has already been started, e.g. a stream that timed out partway through,
+//the error is only logged and the response is aborted so the client can tell the body is incomplete
+func WriteError(res http.ResponseWriter, req *http.Request, err error) {
+	writeError(res, req, database.AsError(err))
+}
+
+func writeError(res http.ResponseWriter, req *http.Request, err *database.Error) {
+	status := err.Kind.Status()
+	logger := logging.FromContext(req.Context())
+	if status >= http.StatusInternalServerError {
+		cause := err.Error()
+		if err.Err != nil {
+			cause = err.Err.Error()
+		}
+		logger.Error("request failed", "code", err.Code, "error", cause, "stack", err.StackTrace)
+		err.Capture(map[string]string{"request_id": res.Header().Get(logging.RequestIDHeader), "method": req.Method, "url": req.URL.String()}, raven.NewHttp(req))
+	} else {
+		logger.Info("request rejected", "code", err.Code, "error", err.Message)
+	}
+	if responseStarted(res) {
+		panic(http.ErrAbortHandler)
+	}
+	res.Header().Set("Content-Type", ProblemContentType)
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(problem{
+		Type:          ProblemTypePrefix + err.Code,
+		Title:         http.StatusText(status),
+		Status:        status,
+		Detail:        err.Message,
+		Instance:      res.Header().Get(logging.RequestIDHeader),
+		Code:          err.Code,
+		InvalidParams: err.InvalidParams,
+	})
+}
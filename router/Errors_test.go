@@ -0,0 +1,77 @@
+package router
+
+import (
+	"errors"
+	"github.com/hunter7654/go-api/database"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(handler http.HandlerFunc) (res *httptest.ResponseRecorder, aborted bool) {
+	res = httptest.NewRecorder()
+	defer func() {
+		aborted = recover() == http.ErrAbortHandler
+	}()
+	HandleError(handler)(res, httptest.NewRequest("GET", "/", nil))
+	return res, false
+}
+
+func TestErrorBeforeResponse(t *testing.T) {
+	res, aborted := serve(Handle(func(w http.ResponseWriter, r *http.Request) error {
+		return database.ErrTimeout
+	}))
+	if aborted {
+		t.Fatal("got the response aborted, want the problem written")
+	}
+	if res.Code != http.StatusGatewayTimeout || res.Header().Get("Content-Type") != ProblemContentType {
+		t.Errorf("got %d %s, want a 504 problem", res.Code, res.Header().Get("Content-Type"))
+	}
+}
+
+func TestErrorAfterResponse(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"panic": func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("[{}"))
+			panic(database.ErrTimeout)
+		},
+		"return": Handle(func(w http.ResponseWriter, r *http.Request) error {
+			w.Write([]byte("[{}"))
+			return database.ErrTimeout
+		}),
+	}
+	for name, handler := range handlers {
+		res, aborted := serve(handler)
+		if !aborted {
+			t.Errorf("%s: got the response finished, want it aborted", name)
+		}
+		if body := res.Body.String(); body != "[{}" || strings.Contains(res.Header().Get("Content-Type"), "problem") {
+			t.Errorf("%s: got body %q, want only what the handler wrote", name, body)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{database.ValidationError("invalid", "not valid"), http.StatusBadRequest, "invalid"},
+		{database.UnauthorizedError("invalid_token", "not valid"), http.StatusUnauthorized, "invalid_token"},
+		{database.ForbiddenError("not_allowed", "not allowed"), http.StatusForbidden, "not_allowed"},
+		{database.NotFoundError("table_not_found", "not found"), http.StatusNotFound, "table_not_found"},
+		{database.ConflictError("constraint_violation", "clash", nil), http.StatusConflict, "constraint_violation"},
+		{database.UnavailableError("database_unavailable", "down", nil), http.StatusServiceUnavailable, "database_unavailable"},
+		{database.TimeoutError("statement_timeout", "too long", nil), http.StatusGatewayTimeout, "statement_timeout"},
+		{errors.New("anything else"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, test := range tests {
+		err := test.err
+		res, _ := serve(func(w http.ResponseWriter, r *http.Request) { panic(err) })
+		if res.Code != test.status || !strings.Contains(res.Body.String(), `"code":"`+test.code+`"`) {
+			t.Errorf("%v: got %d %s, want %d with code %s", test.err, res.Code, res.Body.String(), test.status, test.code)
+		}
+	}
+}
@@ -3,14 +3,19 @@ package router
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/getsentry/raven-go"
 	"github.com/hunter7654/go-api/database"
-	"log"
+	"github.com/hunter7654/go-api/logging"
+	"github.com/hunter7654/go-api/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
-	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,59 +46,174 @@ func Validate(page http.HandlerFunc) http.HandlerFunc {
 		}
 
 		if tokenJson == "" {
-			http.Error(res, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			WriteError(res, req, database.UnauthorizedError("missing_token", "the authorization header must be passed"))
 			return
 		}
 		var tokenArray map[string]string
 		if err := json.Unmarshal([]byte(tokenJson), &tokenArray); err != nil {
-			panic(database.ErrorResponse{Error: err.Error(), StackTrace: string(debug.Stack())})
+			WriteError(res, req, database.ValidationError("token_not_recognised", "the authorization header must hold the json returned by /login"))
+			return
 		}
 
 		parsedToken, err := jwt.ParseWithClaims(tokenArray["token"], &database.JwtData{}, func(token *jwt.Token) (interface{}, error) {
 			return []byte(database.JsonKey), nil
 		})
 		if err != nil {
-			http.Error(res, err.Error(), http.StatusUnauthorized)
+			WriteError(res, req, database.UnauthorizedError("invalid_token", err.Error()))
 			return
 		}
 		if jwtData, ok := parsedToken.Claims.(*database.JwtData); ok && parsedToken.Valid {
+			logging.AddAttributes(req.Context(), "username", jwtData.Username)
 			ctx := context.WithValue(req.Context(), database.MyKey, *jwtData)
 			page(res, req.WithContext(ctx))
 		} else {
-			http.Error(res, err.Error(), http.StatusUnauthorized)
+			WriteError(res, req, database.UnauthorizedError("invalid_token", "the token is not valid"))
 			return
 		}
 	})
 }
 
-//this function handles any errors and stops the program from crashing when it encounters them.
+//this function handles any errors and stops the program from crashing when it encounters them. Requests that
+//panic with anything, including runtime errors, are answered using WriteError
 func HandleError(page http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
 		defer func() {
 			if r := recover(); r != nil {
-				if response, ok := r.(database.ErrorResponse); ok {
-					if response.ErrorObject != nil {
-						raven.CaptureError(response.ErrorObject, nil)
-					}
-					data, _ := json.Marshal(response)
-					http.Error(res, string(data), http.StatusInternalServerError)
-					return
+				//the server aborts the response on purpose with this and expects it to carry on up
+				if r == http.ErrAbortHandler {
+					panic(r)
 				}
-
+				writeError(recorder, req, database.AsError(r))
 			}
 		}()
-		page(res, req)
+		page(recorder, req)
 	})
 }
 
+//warns about requests that take longer than 5 seconds
 func LogTime(page http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
 		start := time.Now()
 		page(res, req)
-		t := time.Now()
-		elapsed := t.Sub(start)
+		elapsed := time.Since(start)
 		if elapsed.Seconds() > 5 {
-			log.Println("URL:	" + req.URL.String() + "	Time taken:	" + fmt.Sprint(elapsed.Seconds()))
+			logging.FromContext(req.Context()).Warn("slow request", "url", req.URL.String(), "seconds", elapsed.Seconds())
+		}
+	})
+}
+
+//the timeout of routes that do not set their own, stored as nanoseconds so it can be changed while requests are running
+var defaultTimeout atomic.Int64
+
+//sets the timeout used by routes that do not set their own. 0 leaves them without a limit
+func SetDefaultTimeout(timeout time.Duration) {
+	defaultTimeout.Store(int64(timeout))
+}
+
+//gives the request a context that ends once the route's timeout has passed, which cancels any database statement
+//run with the request's context. The context also ends when the client disconnects
+func Timeout(route Route, page http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		timeout := route.Timeout
+		if timeout == 0 {
+			timeout = time.Duration(defaultTimeout.Load())
+		}
+		if timeout <= 0 {
+			page(res, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		page(res, req.WithContext(ctx))
+	})
+}
+
+//gives the request a logger carrying its request id, which is taken from the X-Request-ID header or
+//generated and is echoed back in the response. A line is written for every request once it has been answered
+func RequestLog(route Route, page http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestID := req.Header.Get(logging.RequestIDHeader)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = logging.NewRequestID()
+		}
+		res.Header().Set(logging.RequestIDHeader, requestID)
+		args := []interface{}{"request_id", requestID, "method", req.Method, "route", route.Pattern}
+		if spanContext := trace.SpanFromContext(req.Context()).SpanContext(); spanContext.IsValid() {
+			args = append(args, "trace_id", spanContext.TraceID().String())
+		}
+		ctx := logging.NewContext(req.Context(), args...)
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		page(recorder, req.WithContext(ctx))
+		logging.FromContext(ctx).Info("request", "url", req.URL.String(), "remote_addr", req.RemoteAddr, "status", recorder.status, "seconds", time.Since(start).Seconds())
+	})
+}
+
+//the name the request spans are recorded under
+const tracerName = "github.com/hunter7654/go-api/router"
+
+//starts a span for the request, named after the route pattern and carrying on any trace passed in the
+//traceparent header. The span is put in the request's context so database statements become its children
+func Trace(route Route, page http.HandlerFunc) http.HandlerFunc {
+	name := route.Method + " " + route.Pattern
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.route", route.Pattern),
+			attribute.String("http.target", req.URL.RequestURI()),
+		))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		page(recorder, req.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
 		}
 	})
 }
+
+//counts the request and records how long it took, labelled with the route pattern so that every
+//url matching a route is counted together
+func Metrics(route Route, page http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		page(recorder, req)
+		metrics.RequestDuration.WithLabelValues(route.Method, route.Pattern).Observe(time.Since(start).Seconds())
+		metrics.Requests.WithLabelValues(route.Method, route.Pattern, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+//remembers the status code written to the response and whether anything has been sent yet
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.written = true
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(body []byte) (int, error) {
+	recorder.written = true
+	return recorder.ResponseWriter.Write(body)
+}
+
+//passes flushes through so that streamed responses still reach the client as they are written
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		recorder.written = true
+		flusher.Flush()
+	}
+}
+
+//reports whether anything has been sent on a response that HandleError passed on
+func responseStarted(res http.ResponseWriter) bool {
+	recorder, ok := res.(*statusRecorder)
+	return ok && recorder.written
+}
@@ -3,6 +3,7 @@ package router
 import (
 	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 )
 
 //initialises a new router and adds all declared routes
@@ -10,24 +11,48 @@ func NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true).UseEncodedPath()
 	for _, route := range RoutesGroup.defaultRoutes {
 		handler := route.HandlerFunc
+		handler = Timeout(route, handler)
 		handler = LogTime(handler)
 		handler = HandleError(handler)
+		handler = Metrics(route, handler)
+		handler = RequestLog(route, handler)
+		handler = Trace(route, handler)
 		router.Methods(route.Method).Path(route.Pattern).Handler(handler)
 	}
 	for _, route := range RoutesGroup.authRoutes {
 		handler := route.HandlerFunc
+		handler = Timeout(route, handler)
 		handler = LogTime(handler)
 		handler = HandleError(handler)
 		handler = Validate(handler)
+		handler = Metrics(route, handler)
+		handler = RequestLog(route, handler)
+		handler = Trace(route, handler)
 		router.Methods(route.Method).Path(route.Pattern).Handler(handler)
 	}
+	router.NotFoundHandler = unmatched(Route{Pattern: "not_found"}, http.NotFound)
+	router.MethodNotAllowedHandler = unmatched(Route{Pattern: "method_not_allowed"}, func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	})
 	return router
 }
 
+//logs, counts and traces the requests that match no route. They are recorded under the route's pattern
+//rather than their url so that unknown urls do not each get their own metric
+func unmatched(route Route, handler http.HandlerFunc) http.HandlerFunc {
+	handler = Metrics(route, handler)
+	handler = RequestLog(route, handler)
+	handler = Trace(route, handler)
+	return handler
+}
+
 type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	//how long the route's database statements are given before they are cancelled and the request is answered
+	//with 504. When it is 0 the default set with SetDefaultTimeout is used
+	Timeout time.Duration
 }
 type RouteGroup struct {
 	defaultRoutes []Route